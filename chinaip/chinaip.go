@@ -1,6 +1,8 @@
 package chinaip
 
 import (
+	"encoding/binary"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -30,8 +32,26 @@ func IP2Int(ip string) (uint32, error) {
 	return ret, nil
 }
 
-// IsChinaIP returns whether an IPv4 address belongs to China
+// IP62Int converts IPv6 from string format to the int of its first 64 bits,
+// which is enough to tell the network it belongs to
+func IP62Int(ip string) (uint64, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return 0, Error("not ipv6 addr")
+	}
+	return binary.BigEndian.Uint64(parsed[:8]), nil
+}
+
+// IsChinaIP returns whether an IPv4 or IPv6 address belongs to China
 func IsChinaIP(ip string) bool {
+	if strings.Contains(ip, ":") {
+		// IPv4-mapped IPv6 addresses, e.g. ::ffff:1.2.3.4
+		if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+			return IsChinaIP(parsed.To4().String())
+		}
+		return isChinaIPv6(ip)
+	}
+
 	var i, err = IP2Int(ip)
 	if err != nil {
 		return false
@@ -50,3 +70,23 @@ func IsChinaIP(ip string) bool {
 	}
 	return false
 }
+
+func isChinaIPv6(ip string) bool {
+	var i, err = IP62Int(ip)
+	if err != nil {
+		return false
+	}
+	var l = 0
+	var r = len(chinaIPv6s) - 1
+	for l <= r {
+		var mid = int((l + r) / 2)
+		if i < chinaIPv6s[mid][0] {
+			r = mid - 1
+		} else if i > chinaIPv6s[mid][1] {
+			l = mid + 1
+		} else {
+			return true
+		}
+	}
+	return false
+}
@@ -4,8 +4,8 @@ import "testing"
 import "github.com/tuna/freedns-go/chinaip"
 
 func TestIsChinaIP(t *testing.T) {
-	var cn_ips = []string{"114.114.114.114", "220.181.57.216"}
-	var non_cn_ips = []string{"8.8.8.8", "172.217.14.78", "255.255.255.255", "wtf", "114.114.114"}
+	var cn_ips = []string{"114.114.114.114", "220.181.57.216", "240e:e9:6002::1", "2400:3200::1", "2001:da8:8000::1", "::ffff:114.114.114.114"}
+	var non_cn_ips = []string{"8.8.8.8", "172.217.14.78", "255.255.255.255", "wtf", "114.114.114", "2001:4860:4860::8888", "2606:4700:4700::1111", "::1", "2400:3200::zz"}
 
 	for _, ip := range cn_ips {
 		if !chinaip.IsChinaIP(ip) {
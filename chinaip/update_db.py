@@ -1,15 +1,30 @@
 #! /usr/bin/env python3
 
+import ipaddress
+
 import requests
 
 IP_LIST_URL = "https://raw.githubusercontent.com/17mon/china_ip_list/master/china_ip_list.txt"
+# 17mon has no IPv6 list, use the delegations of APNIC instead
+IPV6_LIST_URL = "https://ftp.apnic.net/stats/apnic/delegated-apnic-latest"
 
-def cidr_list():
-    r = requests.get(IP_LIST_URL)
+def fetch(url):
+    r = requests.get(url)
     if r.status_code != 200:
-        raise Exception("%s status code is %d" % (IP_LIST_URL, r.status_code))
-        
-    return r.text.split()
+        raise Exception("%s status code is %d" % (url, r.status_code))
+    return r.text
+
+def cidr_list():
+    return fetch(IP_LIST_URL).split()
+
+def cidr6_list():
+    # lines look like apnic|CN|ipv6|2001:250::|35|20000426|allocated
+    cidrs = []
+    for line in fetch(IPV6_LIST_URL).splitlines():
+        fields = line.split("|")
+        if len(fields) >= 5 and fields[1] == "CN" and fields[2] == "ipv6":
+            cidrs.append("%s/%s" % (fields[3], fields[4]))
+    return cidrs
 
 def to_int(a, b, c, d):
     return a*256*256*256 + b*256*256 + c*256 + d
@@ -23,6 +38,11 @@ def parse(cidr):
     end = start + 2**(32 - mask) - 1
     return start, end
 
+def parse6(cidr):
+    # only the first 64 bits are kept, no allocation is longer than /64
+    net = ipaddress.IPv6Network(cidr)
+    return int(net.network_address) >> 64, int(net.broadcast_address) >> 64
+
 def gen():
     s = """package chinaip
 
@@ -37,11 +57,26 @@ var chinaIPs = [][]uint32{
     s += "}\n"
     return s
 
+def gen6():
+    s = """package chinaip
+
+var chinaIPv6s = [][]uint64{
+"""
+    cidrs = sorted(cidr6_list(), key=lambda cidr: parse6(cidr))
+    for cidr in cidrs:
+        start, end = parse6(cidr)
+        s += "	{%d, %d},     // %s\n" % (start, end, cidr)
+
+    s += "}\n"
+    return s
+
 def main():
     s = gen()
     with open("db.go", "w") as f:
         f.write(s)
+    s = gen6()
+    with open("db6.go", "w") as f:
+        f.write(s)
 
 if __name__ == "__main__":
     main()
-        
\ No newline at end of file
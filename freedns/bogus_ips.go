@@ -0,0 +1,100 @@
+package freedns
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// bogusIPList holds the addresses known to be forged, e.g. the ones injected by the GFW.
+// An answer containing any of them is a proof of spoofing.
+type bogusIPList struct {
+	nets []*net.IPNet
+	// how many answers are found to be forged
+	hits uint64
+}
+
+// newBogusIPList reads the addresses from comma separated files, one per line. A line is
+// an IP address, a CIDR, or a dnsmasq rule like bogus-nxdomain=1.2.3.4. Empty lines and
+// comments starting with "#" are ignored.
+func newBogusIPList(files string) (*bogusIPList, error) {
+	l := &bogusIPList{}
+	for _, filename := range splitFileList(files) {
+		if err := l.load(filename); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *bogusIPList) load(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "bogus-nxdomain="))
+		if line == "" {
+			continue
+		}
+
+		if !strings.Contains(line, "/") {
+			if ip := net.ParseIP(line); ip != nil && ip.To4() != nil {
+				line += "/32"
+			} else {
+				line += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(line)
+		if err != nil {
+			return Error("Invalid bogus IP at " + filename + ":" + strconv.Itoa(lineno) + ": " + line)
+		}
+		l.nets = append(l.nets, ipnet)
+	}
+	return scanner.Err()
+}
+
+// contains checks if any address in the answer is bogus. It is safe to call on nil list.
+func (l *bogusIPList) contains(res *dns.Msg) bool {
+	if l == nil || res == nil {
+		return false
+	}
+	for _, rr := range res.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+		for _, ipnet := range l.nets {
+			if ipnet.Contains(ip) {
+				atomic.AddUint64(&l.hits, 1)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// count returns how many answers are found to be forged.
+func (l *bogusIPList) count() uint64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&l.hits)
+}
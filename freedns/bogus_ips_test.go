@@ -0,0 +1,59 @@
+package freedns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBogusIPList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_bogus_ips")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/bogus"
+	writeTempFile(t, filename, "# forged by the GFW\n243.185.187.39\n\nbogus-nxdomain=198.18.0.0/15 # benchmark\n2001:db8::/32\n")
+
+	l, err := newBogusIPList(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip    string
+		bogus bool
+	}{
+		{"243.185.187.39", true},
+		{"243.185.187.40", false},
+		{"198.19.1.1", true},
+		{"2001:db8::1", true},
+		{"2001:4860:4860::8888", false},
+	}
+	for _, tt := range tests {
+		res := &dns.Msg{}
+		if ip := net.ParseIP(tt.ip); ip.To4() != nil {
+			res.Answer = append(res.Answer, &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: ip})
+		} else {
+			res.Answer = append(res.Answer, &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: ip})
+		}
+		if got := l.contains(res); got != tt.bogus {
+			t.Errorf("%s should be bogus %v, got %v", tt.ip, tt.bogus, got)
+		}
+	}
+	if l.count() != 3 {
+		t.Errorf("Expect 3 hits, got %d", l.count())
+	}
+
+	var empty *bogusIPList
+	if empty.contains(&dns.Msg{}) || empty.count() != 0 {
+		t.Errorf("Nil list should contain nothing")
+	}
+
+	writeTempFile(t, filename, "not-an-ip\n")
+	if _, err := newBogusIPList(filename); err == nil {
+		t.Errorf("Expect error for invalid IP")
+	}
+}
@@ -0,0 +1,193 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// bootstrapMinTTL avoids querying the bootstrap servers over and over
+	// for hostnames with tiny TTLs.
+	bootstrapMinTTL  = 30 * time.Second
+	bootstrapTimeout = 2 * time.Second
+)
+
+// bootstrapResolver resolves the hostnames of the upstreams by the bootstrap servers,
+// which must be IP addresses. The bootstrap servers are queried directly by plain DNS,
+// so the resolution of the upstreams does not depend on the upstreams themselves,
+// nor on the system resolver, which may be freedns itself.
+type bootstrapResolver struct {
+	servers []string
+
+	mu    sync.Mutex
+	hosts map[string]*bootstrapEntry
+}
+
+type bootstrapEntry struct {
+	ips        []net.IP
+	expire     time.Time
+	refreshing bool
+}
+
+// newBootstrapResolver parses a comma separated list of bootstrap servers.
+func newBootstrapResolver(servers string) (*bootstrapResolver, error) {
+	b := &bootstrapResolver{
+		hosts: make(map[string]*bootstrapEntry),
+	}
+	for _, s := range strings.Split(servers, ",") {
+		server, err := normalizeDnsAddress(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		b.servers = append(b.servers, server)
+	}
+	return b, nil
+}
+
+// lookup returns the addresses of `host`. The addresses are cached until
+// their TTL expires. After that, the expired addresses are still returned
+// while they are being resolved again in the background, so a slow or
+// failing bootstrap server does not delay the queries to the upstream.
+func (b *bootstrapResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	b.mu.Lock()
+	e, ok := b.hosts[host]
+	if ok {
+		if time.Now().After(e.expire) && !e.refreshing {
+			e.refreshing = true
+			go b.refresh(host)
+		}
+		ips := e.ips
+		b.mu.Unlock()
+		return ips, nil
+	}
+	b.mu.Unlock()
+
+	ips, ttl, err := b.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	b.hosts[host] = &bootstrapEntry{ips: ips, expire: time.Now().Add(ttl)}
+	b.mu.Unlock()
+	return ips, nil
+}
+
+// refresh resolves `host` again, and keeps the old addresses if it fails.
+func (b *bootstrapResolver) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), bootstrapTimeout)
+	defer cancel()
+	ips, ttl, err := b.resolve(ctx, host)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.hosts[host]
+	e.refreshing = false
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"op":   "bootstrap",
+			"host": host,
+		}).Warn("Cannot resolve again, keep the old addresses: ", err)
+		return
+	}
+	e.ips, e.expire = ips, time.Now().Add(ttl)
+}
+
+// resolve asks the bootstrap servers in order for the IPv4 addresses of `host`,
+// or the IPv6 addresses if there is none. It returns the addresses and
+// the smallest TTL of them.
+func (b *bootstrapResolver) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	var err error
+	for _, server := range b.servers {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			q := dns.Question{Name: dns.Fqdn(host), Qtype: qtype, Qclass: dns.ClassINET}
+			var res *dns.Msg
+			res, _, err = naiveResolve(ctx, q, true, "udp", server)
+			if err != nil {
+				break
+			}
+			if res.Rcode != dns.RcodeSuccess {
+				err = Error("Cannot resolve " + host + ": " + dns.RcodeToString[res.Rcode])
+				break
+			}
+
+			var ips []net.IP
+			ttl := uint32(0)
+			for _, rr := range res.Answer {
+				var ip net.IP
+				switch rr := rr.(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				default:
+					continue
+				}
+				if ttl == 0 || rr.Header().Ttl < ttl {
+					ttl = rr.Header().Ttl
+				}
+				ips = append(ips, ip)
+			}
+			if len(ips) > 0 {
+				d := time.Duration(ttl) * time.Second
+				if d < bootstrapMinTTL {
+					d = bootstrapMinTTL
+				}
+				return ips, d, nil
+			}
+			err = Error("No address found for " + host)
+		}
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+	}
+	return nil, 0, err
+}
+
+// bootstrapDialer resolves hostnames by a bootstrapResolver,
+// and connects to the resolved addresses by another dialer.
+type bootstrapDialer struct {
+	dialer   dialer
+	resolver *bootstrapResolver
+}
+
+// newBootstrapDialer wraps `d` to resolve hostnames by the bootstrap servers.
+// It returns `d` itself if there is no bootstrap server.
+func newBootstrapDialer(d dialer, servers string) (dialer, error) {
+	if servers == "" {
+		return d, nil
+	}
+	resolver, err := newBootstrapResolver(servers)
+	if err != nil {
+		return nil, err
+	}
+	return &bootstrapDialer{dialer: d, resolver: resolver}, nil
+}
+
+func (d *bootstrapDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+
+	ips, err := d.resolver.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil || err == errUDPUnsupported || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,109 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newBootstrapStandIn starts a DNS server which resolves dns.test to 127.0.0.1,
+// and returns its address and the number of queries it answered.
+func newBootstrapStandIn(t *testing.T) (string, *int32, func()) {
+	queries := new(int32)
+	addr, stop := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		res := &dns.Msg{}
+		res.SetReply(req)
+		q := req.Question[0]
+		if q.Name != "dns.test." {
+			res.Rcode = dns.RcodeNameError
+		} else if q.Qtype == dns.TypeA {
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   net.IPv4(127, 0, 0, 1),
+			})
+		}
+		w.WriteMsg(res)
+	})
+	return addr, queries, stop
+}
+
+func TestHostnameUpstreamProvider(t *testing.T) {
+	for _, name := range []string{"dns.test", "https://dns.test/dns-query", "tls://dns.test", "8.8.8.8,dns.test"} {
+		if _, err := newUpstreamProvider(name, upstreamOptions{}); err == nil {
+			t.Errorf("Should not create provider for %s without bootstrap servers", name)
+		}
+		if _, err := newUpstreamProvider(name, upstreamOptions{bootstrap: "127.0.0.1"}); err != nil {
+			t.Errorf("Cannot create provider for %s: %s", name, err.Error())
+		}
+	}
+
+	provider, _ := newUpstreamProvider("dns.test", upstreamOptions{bootstrap: "127.0.0.1"})
+	if upstream := provider.GetUpstream(); upstream != "dns.test:53" {
+		t.Errorf("Hostname upstream provider invalid result %s", upstream)
+	}
+
+	if _, err := newUpstreamProvider("8.8.8.8", upstreamOptions{bootstrap: "dns.test"}); err == nil {
+		t.Errorf("Should not accept hostnames as bootstrap servers")
+	}
+}
+
+func TestBootstrapResolve(t *testing.T) {
+	bootstrap, queries, stopBootstrap := newBootstrapStandIn(t)
+	defer stopBootstrap()
+	upstream, stop := startTestDNSServer(t, "udp", answerLocalhost)
+	defer stop()
+	_, port, _ := net.SplitHostPort(upstream)
+
+	provider, err := newUpstreamProvider("dns.test:"+port, upstreamOptions{bootstrap: bootstrap})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := provider.transports()
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	for i := 0; i < 3; i++ {
+		res, _, err := ts.resolve(context.Background(), q, true, nil, "udp", provider.GetUpstream())
+		if err != nil {
+			t.Fatalf("Resolve by hostname upstream failed: %s", err.Error())
+		}
+		if len(res.Answer) != 1 {
+			t.Errorf("Resolve by hostname upstream got wrong answer %v", res)
+		}
+	}
+	if n := atomic.LoadInt32(queries); n != 1 {
+		t.Errorf("The address of the upstream should be cached, got %d bootstrap queries", n)
+	}
+
+	// once expired, the old address is used while it is resolved again
+	resolver := ts.dialer.(*bootstrapDialer).resolver
+	resolver.mu.Lock()
+	resolver.hosts["dns.test"].expire = time.Now().Add(-time.Second)
+	resolver.mu.Unlock()
+	if _, _, err := ts.resolve(context.Background(), q, true, nil, "udp", provider.GetUpstream()); err != nil {
+		t.Errorf("Resolve with expired address failed: %s", err.Error())
+	}
+	refreshed := func() bool {
+		resolver.mu.Lock()
+		defer resolver.mu.Unlock()
+		return resolver.hosts["dns.test"].expire.After(time.Now())
+	}
+	for i := 0; i < 100 && !refreshed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !refreshed() {
+		t.Errorf("The address of the upstream should be refreshed")
+	}
+	if n := atomic.LoadInt32(queries); n != 2 {
+		t.Errorf("The address of the upstream should be resolved again, got %d bootstrap queries", n)
+	}
+
+	provider, _ = newUpstreamProvider("unknown.test:"+port, upstreamOptions{bootstrap: bootstrap})
+	if _, _, err := provider.transports().resolve(context.Background(), q, true, nil, "udp", provider.GetUpstream()); err == nil {
+		t.Errorf("Should fail for unknown hostname")
+	}
+}
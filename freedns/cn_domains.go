@@ -0,0 +1,255 @@
+package freedns
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// defaultCNDomainsTTL is how long a verdict is trusted by default.
+const defaultCNDomainsTTL = 7 * 24 * time.Hour
+
+// cnDomainCache caches if a domain belongs to China. It is an LRU cache like dnsCache,
+// but also remembers when each verdict is made, so the verdicts expire after `ttl`,
+// and can be saved to a file to survive restarts.
+type cnDomainCache struct {
+	mu  sync.Mutex
+	cap int
+	ttl time.Duration
+	// the front is the most recently used
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cnVerdict struct {
+	name string
+	isCN bool
+	at   time.Time
+	// the verdict of a registrable domain may be inherited from its subdomains,
+	// which vote for it, see setRegistrable
+	inherited    bool
+	votesCN      int
+	votesForeign int
+}
+
+func newCNDomainCache(maxCap int, ttl time.Duration) *cnDomainCache {
+	return &cnDomainCache{
+		cap:     maxCap,
+		ttl:     ttl,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the verdict of `name`, and false if there is none or it has expired.
+func (c *cnDomainCache) get(name string) (isCN bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getLocked(strings.ToLower(name))
+}
+
+func (c *cnDomainCache) getLocked(name string) (isCN bool, ok bool) {
+	e, ok := c.entries[name]
+	if !ok {
+		return false, false
+	}
+	v := e.Value.(*cnVerdict)
+	if time.Since(v.at) > c.ttl {
+		c.lru.Remove(e)
+		delete(c.entries, name)
+		return false, false
+	}
+	c.lru.MoveToFront(e)
+	return v.isCN, true
+}
+
+func (c *cnDomainCache) set(name string, isCN bool) {
+	c.add(strings.ToLower(name), isCN, time.Now())
+}
+
+// getParent returns the verdict of the nearest parent of `name` which has one.
+// The parents are searched up to the registrable domain, e.g. for mail.ustc.edu.cn.
+// they are ustc.edu.cn., but not edu.cn. which is a public suffix.
+func (c *cnDomainCache) getParent(name string) (isCN bool, ok bool) {
+	name = strings.ToLower(name)
+	registrable := registrableDomain(name)
+	if registrable == "" {
+		return false, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for parent := name; parent != registrable; {
+		i := strings.Index(parent, ".")
+		if i < 0 || i == len(parent)-1 {
+			break
+		}
+		parent = parent[i+1:]
+		if isCN, ok := c.getLocked(parent); ok {
+			return isCN, true
+		}
+	}
+	return false, false
+}
+
+// setRegistrable votes the verdict of `name` for its registrable domain, which takes the
+// verdict of the majority of its subdomains, or the latest one on a tie. So a subdomain
+// hosted abroad, e.g. by a CDN, does not decide for all the others. The verdict of the
+// registrable domain itself is direct evidence, which is not overridden by the votes.
+func (c *cnDomainCache) setRegistrable(name string, isCN bool) {
+	name = strings.ToLower(name)
+	registrable := registrableDomain(name)
+	if registrable == "" || registrable == name {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v := &cnVerdict{name: registrable, inherited: true}
+	if e, ok := c.entries[registrable]; ok {
+		if old := e.Value.(*cnVerdict); time.Since(old.at) <= c.ttl {
+			if !old.inherited {
+				return
+			}
+			v = old
+		}
+	}
+	if isCN {
+		v.votesCN++
+	} else {
+		v.votesForeign++
+	}
+	v.isCN = v.votesCN > v.votesForeign || (v.votesCN == v.votesForeign && isCN)
+	v.at = time.Now()
+	c.addLocked(v)
+}
+
+// registrableDomain returns the registrable domain (public suffix plus one label)
+// of `name`, or "" if `name` is a public suffix itself.
+func registrableDomain(name string) string {
+	registrable, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return ""
+	}
+	return dns.Fqdn(registrable)
+}
+
+// add puts the direct verdict made at `at`.
+func (c *cnDomainCache) add(name string, isCN bool, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(&cnVerdict{name: name, isCN: isCN, at: at})
+}
+
+// addLocked puts `v` in place of the verdict of the same name, and evicts the least
+// recently used ones if full.
+func (c *cnDomainCache) addLocked(v *cnVerdict) {
+	if e, ok := c.entries[v.name]; ok {
+		e.Value = v
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[v.name] = c.lru.PushFront(v)
+	for c.lru.Len() > c.cap {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*cnVerdict).name)
+	}
+}
+
+// save writes the verdicts which have not expired to `filename`, one per line:
+//
+//	<domain> <1 if it belongs to China, otherwise 0> <unix time of the verdict>
+//
+// followed by the votes for and against China if the verdict is inherited from the subdomains.
+//
+// The file is replaced atomically, so a crash never leaves a broken file behind.
+func (c *cnDomainCache) save(filename string) error {
+	var b strings.Builder
+	c.mu.Lock()
+	// from the least recently used, so the order is kept after loading
+	for e := c.lru.Back(); e != nil; e = e.Prev() {
+		v := e.Value.(*cnVerdict)
+		if time.Since(v.at) > c.ttl {
+			continue
+		}
+		isCN := 0
+		if v.isCN {
+			isCN = 1
+		}
+		if v.inherited {
+			fmt.Fprintf(&b, "%s %d %d %d %d\n", v.name, isCN, v.at.Unix(), v.votesCN, v.votesForeign)
+		} else {
+			fmt.Fprintf(&b, "%s %d %d\n", v.name, isCN, v.at.Unix())
+		}
+	}
+	c.mu.Unlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// load reads the verdicts saved by save, the expired ones are skipped.
+// It is not an error if the file does not exist yet.
+func (c *cnDomainCache) load(filename string) error {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		invalid := Error("Invalid line " + strconv.Itoa(lineno) + " in " + filename)
+		if (len(fields) != 3 && len(fields) != 5) || (fields[1] != "0" && fields[1] != "1") {
+			return invalid
+		}
+		v := &cnVerdict{name: fields[0], isCN: fields[1] == "1"}
+		unix, err := strconv.ParseInt(fields[2], 10, 64)
+		if len(fields) == 5 && err == nil {
+			v.inherited = true
+			if v.votesCN, err = strconv.Atoi(fields[3]); err == nil {
+				v.votesForeign, err = strconv.Atoi(fields[4])
+			}
+		}
+		if err != nil {
+			return invalid
+		}
+		v.at = time.Unix(unix, 0)
+		if time.Since(v.at) > c.ttl {
+			continue
+		}
+		c.mu.Lock()
+		c.addLocked(v)
+		c.mu.Unlock()
+	}
+	return scanner.Err()
+}
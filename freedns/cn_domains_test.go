@@ -0,0 +1,190 @@
+package freedns
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCNDomainCache(t *testing.T) {
+	c := newCNDomainCache(2, time.Hour)
+	c.set("a.cn.", true)
+	c.set("b.com.", false)
+	if isCN, ok := c.get("a.cn."); !ok || !isCN {
+		t.Errorf("a.cn. should belong to China")
+	}
+	// b.com. is the least recently used now
+	c.set("c.cn.", true)
+	if _, ok := c.get("b.com."); ok {
+		t.Errorf("b.com. should be evicted")
+	}
+
+	c.add("old.cn.", true, time.Now().Add(-2*time.Hour))
+	if _, ok := c.get("old.cn."); ok {
+		t.Errorf("old.cn. should be expired")
+	}
+}
+
+func TestCNDomainCacheSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cn_domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/cn_domains"
+
+	c := newCNDomainCache(16, time.Hour)
+	if err := c.load(filename); err != nil {
+		t.Errorf("Missing file should not be an error: %s", err.Error())
+	}
+	c.set("ustc.edu.cn.", true)
+	c.set("google.com.", false)
+	c.setRegistrable("www.example.cn.", true)
+	c.setRegistrable("static.example.cn.", false)
+	c.setRegistrable("mail.example.cn.", true)
+	c.setRegistrable("ftp.example.cn.", true)
+	c.add("old.cn.", true, time.Now().Add(-2*time.Hour))
+	if err := c.save(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newCNDomainCache(16, time.Hour)
+	if err := loaded.load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if isCN, ok := loaded.get("ustc.edu.cn."); !ok || !isCN {
+		t.Errorf("ustc.edu.cn. should be loaded as China domain")
+	}
+	if isCN, ok := loaded.get("google.com."); !ok || isCN {
+		t.Errorf("google.com. should be loaded as non-China domain")
+	}
+	// the votes of the subdomains are kept
+	loaded.setRegistrable("cdn.example.cn.", false)
+	if isCN, ok := loaded.get("example.cn."); !ok || !isCN {
+		t.Errorf("example.cn. should be loaded with the votes of its subdomains")
+	}
+	loaded.setRegistrable("img.example.cn.", false)
+	loaded.setRegistrable("js.example.cn.", false)
+	if isCN, _ := loaded.get("example.cn."); isCN {
+		t.Errorf("example.cn. should be outvoted after loading")
+	}
+	if loaded.lru.Len() != 3 {
+		t.Errorf("Expired verdicts should not be saved, loaded %d", loaded.lru.Len())
+	}
+
+	// verdicts expire by the time they are made, not loaded
+	expired := strconv.FormatInt(time.Now().Add(-2*time.Hour).Unix(), 10)
+	writeTempFile(t, filename, "old.cn. 1 "+expired+"\n")
+	loaded = newCNDomainCache(16, time.Hour)
+	loaded.load(filename)
+	if _, ok := loaded.get("old.cn."); ok {
+		t.Errorf("Expired verdict should not be loaded")
+	}
+
+	for _, content := range []string{"a.cn.\n", "a.cn. 2 0\n", "a.cn. 1\n", "a.cn. 1 yesterday\n", "a.cn. 1 0 1\n", "a.cn. 1 0 1 x\n"} {
+		writeTempFile(t, filename, content)
+		if err := newCNDomainCache(16, time.Hour).load(filename); err == nil {
+			t.Errorf("Should not load %q", content)
+		}
+	}
+}
+
+func TestServerPersistsCNDomains(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_cn_domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		FastUpstream:  "127.0.0.1",
+		CleanUpstream: "127.0.0.1",
+		Listen:        "127.0.0.1:0",
+		CacheCap:      16,
+		CNDomainsFile: dir + "/cn_domains",
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.resolver.cnDomains.set("ustc.edu.cn.", true)
+	s.Shutdown()
+
+	s, err = NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	if isCN, ok := s.resolver.cnDomains.get("ustc.edu.cn."); !ok || !isCN {
+		t.Errorf("The verdict should survive restarts")
+	}
+}
+
+func TestCNDomainCacheParent(t *testing.T) {
+	c := newCNDomainCache(16, time.Hour)
+	c.set("ustc.edu.cn.", true)
+	c.set("edu.cn.", false)
+
+	if isCN, ok := c.getParent("mail.ustc.edu.cn."); !ok || !isCN {
+		t.Errorf("mail.ustc.edu.cn. should inherit from ustc.edu.cn.")
+	}
+	if isCN, ok := c.getParent("Mail.Lab.USTC.edu.cn."); !ok || !isCN {
+		t.Errorf("Mail.Lab.USTC.edu.cn. should inherit from ustc.edu.cn.")
+	}
+	// edu.cn. is a public suffix, which says nothing about the domains under it
+	if _, ok := c.getParent("www.tsinghua.edu.cn."); ok {
+		t.Errorf("www.tsinghua.edu.cn. should not inherit from a public suffix")
+	}
+
+	c.setRegistrable("www.example.cn.", true)
+	if isCN, ok := c.get("example.cn."); !ok || !isCN {
+		t.Errorf("The verdict should be recorded for the registrable domain")
+	}
+	c.setRegistrable("com.", false)
+	if _, ok := c.get("com."); ok {
+		t.Errorf("Public suffix should not be recorded")
+	}
+}
+
+func TestCNDomainCacheRegistrableVotes(t *testing.T) {
+	c := newCNDomainCache(16, time.Hour)
+
+	// a subdomain hosted abroad first, then the subdomains in China outvote it
+	c.setRegistrable("static.example.cn.", false)
+	if isCN, ok := c.get("example.cn."); !ok || isCN {
+		t.Errorf("example.cn. should take the only verdict of its subdomains")
+	}
+	c.setRegistrable("www.example.cn.", true)
+	if isCN, _ := c.get("example.cn."); !isCN {
+		t.Errorf("example.cn. should take the latest verdict on a tie")
+	}
+	c.setRegistrable("mail.example.cn.", true)
+	c.setRegistrable("cdn.example.cn.", false)
+	if isCN, _ := c.get("example.cn."); isCN {
+		t.Errorf("example.cn. should take the latest verdict on a tie")
+	}
+	c.setRegistrable("ftp.example.cn.", true)
+	c.setRegistrable("img.example.cn.", false)
+	c.setRegistrable("bbs.example.cn.", true)
+	if isCN, _ := c.get("example.cn."); !isCN {
+		t.Errorf("example.cn. should take the verdict of the majority")
+	}
+	if isCN, ok := c.getParent("news.example.cn."); !ok || !isCN {
+		t.Errorf("news.example.cn. should inherit the verdict of the majority")
+	}
+
+	// the verdict of the registrable domain itself is not overridden by the subdomains
+	c.set("example.com.", false)
+	c.setRegistrable("www.example.com.", true)
+	c.setRegistrable("mail.example.com.", true)
+	if isCN, _ := c.get("example.com."); isCN {
+		t.Errorf("example.com. should keep its own verdict")
+	}
+	c.set("example.cn.", false)
+	c.setRegistrable("www.example.cn.", true)
+	if isCN, _ := c.get("example.cn."); isCN {
+		t.Errorf("The verdict of example.cn. itself should override the votes")
+	}
+}
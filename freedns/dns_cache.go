@@ -9,45 +9,199 @@ import (
 
 type cacheEntry struct {
 	putin time.Time
+	// when the record with the smallest TTL expires, the entry is not served after it
+	expire time.Time
+	// reply keeps the original TTLs, they are counted down from putin when served
 	reply *dns.Msg
+	// scope is the scope prefix of the answers to the question, if the entry is
+	// the index of the answers depending on the client subnet, see dnsCache.get
+	scope uint8
 }
 
+// ecsIndexSuffix is appended to the key of a request for the index of the answers
+// depending on the client subnet.
+const ecsIndexSuffix = "_ecs"
+
+const (
+	// defaultNegativeTTL is how long a negative answer is cached at most by default.
+	defaultNegativeTTL = time.Hour
+	// staleAnswerTTL is the TTL of the expired answers served when the upstreams fail,
+	// as recommended by RFC 8767.
+	staleAnswerTTL = 30
+	// prefetchTTL is the remaining TTL in seconds under which an answer is updated in the background.
+	prefetchTTL = 3
+)
+
 type dnsCache struct {
 	backend *goc.Cache
+	// negativeTTL caps how long NXDOMAIN and NODATA answers are cached
+	negativeTTL time.Duration
+	// staleWindow is how long the expired answers are kept to be served if the upstreams fail,
+	// 0 disables it.
+	staleWindow time.Duration
+	// ttlPolicy rewrites the TTLs of the answers before they are cached, nil if there is none
+	ttlPolicy *ttlPolicy
 }
 
 func newDNSCache(maxCap int) *dnsCache {
 	c, _ := goc.NewCache("lru", maxCap)
 	return &dnsCache{
-		backend: c,
+		backend:     c,
+		negativeTTL: defaultNegativeTTL,
 	}
 }
 
-func (c *dnsCache) set(res *dns.Msg, net string) {
-	key := requestToString(res.Question[0], res.RecursionDesired, net)
+// cacheable returns whether `res` can be cached: successful answers, NODATA and NXDOMAIN,
+// but not truncated ones, which are incomplete.
+func cacheable(res *dns.Msg) bool {
+	return (res.Rcode == dns.RcodeSuccess || res.Rcode == dns.RcodeNameError) && !res.Truncated
+}
+
+// set caches `res` for the requests with the same question, recursion desired flag,
+// EDNS options `opt` (nil if without EDNS) and protocol.
+//
+// The answers are shared by the clients by the scope prefix given by the upstream (RFC 7871
+// section 7.3.1). An answer without scope is shared by all the clients, while an answer of
+// scope /16 is shared by the clients in the same /16 subnet. The scope is kept in an index
+// entry, which tells the subnet to look up for the clients.
+//
+// The negative answers (NXDOMAIN and NODATA) are cached as RFC 2308 says: for the TTL of
+// the SOA record in the authority section, but no longer than its MINIMUM field and
+// `negativeTTL`, and not at all if there is no SOA record. The TTLs of the other answers
+// are rewritten by ttlPolicy.
+func (c *dnsCache) set(res *dns.Msg, opt *dns.OPT, net string) {
+	key := requestToString(res.Question[0], res.RecursionDesired, opt, net)
+	scope := ecsScope(res, opt)
+	reply := res.Copy() // .Copy() is mandatory
+	c.ttlPolicy.apply(reply)
+
+	if reply.Rcode == dns.RcodeNameError || len(reply.Answer) == 0 {
+		var soa *dns.SOA
+		for _, rr := range reply.Ns {
+			if s, ok := rr.(*dns.SOA); ok {
+				soa = s
+				break
+			}
+		}
+		if soa == nil {
+			return
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if max := uint32(c.negativeTTL / time.Second); max < ttl {
+			ttl = max
+		}
+		soa.Hdr.Ttl = ttl
+	}
 
+	now := time.Now()
+	expire := now.Add(time.Duration(minTTL(reply)) * time.Second)
+	if scope > 0 {
+		c.backend.Set(key+ecsIndexSuffix, cacheEntry{putin: now, expire: expire, scope: scope})
+		key += "_" + subnetToString(findECS(opt), scope)
+	} else if _, ok := c.backend.Get(key + ecsIndexSuffix); ok {
+		// the answers do not depend on the client subnet any more
+		c.backend.Set(key+ecsIndexSuffix, cacheEntry{putin: now, expire: expire})
+	}
 	c.backend.Set(key, cacheEntry{
-		putin: time.Now(),
-		reply: res.Copy(), // .Copy() is mandatory
+		putin:  now,
+		expire: expire,
+		reply:  reply,
 	})
 }
 
-func (c *dnsCache) lookup(q dns.Question, recursion bool, net string) (*dns.Msg, bool) {
-	key := requestToString(q, recursion, net)
+// get returns the cached entry for the request. If the answers depend on the client subnet,
+// only the one for the subnet of the client is returned.
+func (c *dnsCache) get(q dns.Question, recursion bool, opt *dns.OPT, net string) (cacheEntry, bool) {
+	key := requestToString(q, recursion, opt, net)
+	if ecs := findECS(opt); ecs != nil && ecs.SourceNetmask > 0 {
+		if ci, ok := c.backend.Get(key + ecsIndexSuffix); ok && ci.(cacheEntry).scope > 0 {
+			scope := ci.(cacheEntry).scope
+			if scope > ecs.SourceNetmask {
+				scope = ecs.SourceNetmask
+			}
+			key += "_" + subnetToString(ecs, scope)
+		}
+	}
 	ci, ok := c.backend.Get(key)
-	if ok {
-		entry := ci.(cacheEntry)
-		res := entry.reply.Copy() // .Copy() is mandatory
-		delta := time.Now().Sub(entry.putin).Seconds()
-		needUpdate := subTTL(res, int(delta))
+	if !ok {
+		return cacheEntry{}, false
+	}
+	return ci.(cacheEntry), true
+}
 
-		return res, needUpdate
+// lookup returns the cached answer to the request with the TTLs counted down since it was
+// cached, or nil if there is none or it has expired. It also returns whether the answer
+// should be updated, which is true if it expires within prefetchTTL seconds.
+func (c *dnsCache) lookup(q dns.Question, recursion bool, opt *dns.OPT, net string) (*dns.Msg, bool) {
+	entry, ok := c.get(q, recursion, opt, net)
+	if !ok {
+		return nil, true
 	}
-	return nil, true
+	now := time.Now()
+	if !now.Before(entry.expire) {
+		// expired, it is only kept for lookupStale
+		return nil, true
+	}
+	res := entry.reply.Copy() // .Copy() is mandatory
+	needUpdate := subTTL(res, int(now.Sub(entry.putin)/time.Second))
+
+	return res, needUpdate
+}
+
+// lookupStale returns the answer which has expired within the stale window, with the TTLs
+// set to staleAnswerTTL. It is served when the upstreams fail to answer, see RFC 8767.
+func (c *dnsCache) lookupStale(q dns.Question, recursion bool, opt *dns.OPT, net string) *dns.Msg {
+	if c.staleWindow <= 0 {
+		return nil
+	}
+	entry, ok := c.get(q, recursion, opt, net)
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.Before(entry.expire) || now.After(entry.expire.Add(c.staleWindow)) {
+		return nil
+	}
+	res := entry.reply.Copy() // .Copy() is mandatory
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if hasTTL(rr) {
+				rr.Header().Ttl = staleAnswerTTL
+			}
+		}
+	}
+	return res
+}
+
+// hasTTL returns whether the TTL of `rr` is a TTL, unlike the one of OPT records,
+// which holds the extended rcode and flags (RFC 6891 section 6.1.3).
+func hasTTL(rr dns.RR) bool {
+	return rr.Header().Rrtype != dns.TypeOPT
+}
+
+// minTTL returns the smallest TTL of the records in `res`, which is how long it can be cached.
+func minTTL(res *dns.Msg) uint32 {
+	ttl, found := uint32(0), false
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if !hasTTL(rr) {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl, found = rr.Header().Ttl, true
+			}
+		}
+	}
+	return ttl
 }
 
 // requestToString generates a string that uniquely identifies the request.
-func requestToString(q dns.Question, recursion bool, net string) string {
+// The DO bit changes the answer, so it is part of it. The client subnet is not,
+// as the answers are shared by their scopes, see dnsCache.set.
+func requestToString(q dns.Question, recursion bool, opt *dns.OPT, net string) string {
 	s := q.Name + "_" + dns.TypeToString[q.Qtype] + "_" + dns.ClassToString[q.Qclass]
 	if recursion {
 		s += "_1"
@@ -55,20 +209,28 @@ func requestToString(q dns.Question, recursion bool, net string) string {
 		s += "_0"
 	}
 	s += "_" + net
+	if opt != nil && opt.Do() {
+		s += "_do"
+	}
 	return s
 }
 
-// subTTL substracts the ttl of `res` by delta in place,
-// and returns true if it will be expired in 3 seconds.
+// subTTL substracts the ttl of `res` by delta in place, from the original TTLs
+// kept in the cache, and returns true if it will be expired in prefetchTTL seconds.
 func subTTL(res *dns.Msg, delta int) bool {
 	needUpdate := false
 	S := func(rr []dns.RR) {
 		for i := 0; i < len(rr); i++ {
+			if !hasTTL(rr[i]) {
+				continue
+			}
 			newTTL := int(rr[i].Header().Ttl)
 			newTTL -= delta
 
-			if newTTL <= 3 {
-				newTTL = 3
+			if newTTL < 0 {
+				newTTL = 0
+			}
+			if newTTL <= prefetchTTL {
 				needUpdate = true
 			}
 
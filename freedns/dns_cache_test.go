@@ -30,11 +30,11 @@ func TestAll(t *testing.T) {
 	}
 
 	c := newDNSCache(10)
-	c.set(req, "udp")
+	c.set(req, nil, "udp")
 
 	// query 1
 	time.Sleep(1 * time.Second)
-	res, upd := c.lookup(req.Question[0], req.RecursionDesired, "udp")
+	res, upd := c.lookup(req.Question[0], req.RecursionDesired, nil, "udp")
 	if res.Answer[0].(*dns.A).Hdr.Name != req.Answer[0].(*dns.A).Hdr.Name {
 		t.Errorf("lookup returns wrong result!")
 	}
@@ -44,15 +44,245 @@ func TestAll(t *testing.T) {
 
 	// query 2
 	time.Sleep(1 * time.Second)
-	res, upd = c.lookup(req.Question[0], req.RecursionDesired, "udp")
+	res, upd = c.lookup(req.Question[0], req.RecursionDesired, nil, "udp")
 	if !upd || res.Answer[0].(*dns.A).Hdr.Ttl > 3 {
 		t.Errorf("the tll should be no more than 3 and need to update")
 	}
 
 	// query 3
 	req.Question[0].Name = "random.org"
-	res, upd = c.lookup(req.Question[0], req.RecursionDesired, "udp")
+	res, upd = c.lookup(req.Question[0], req.RecursionDesired, nil, "udp")
 	if res != nil {
 		t.Errorf("res should be nil")
 	}
 }
+
+func TestCacheExpiry(t *testing.T) {
+	res := &dns.Msg{}
+	res.SetQuestion("example.com.", dns.TypeA)
+	res.Answer = append(res.Answer,
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 3600},
+			Target: "cdn.example.net.",
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "cdn.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+	q := res.Question[0]
+	key := requestToString(q, true, nil, "udp")
+
+	c := newDNSCache(10)
+	now := time.Now()
+	c.backend.Set(key, cacheEntry{putin: now.Add(-100 * time.Second), expire: now.Add(200 * time.Second), reply: res})
+	cached, upd := c.lookup(q, true, nil, "udp")
+	if cached == nil || upd {
+		t.Fatalf("Answer within its TTL should be served without update")
+	}
+	if cached.Answer[0].Header().Ttl != 3500 || cached.Answer[1].Header().Ttl != 200 {
+		t.Errorf("TTLs should count down from the original ones, got %v", cached.Answer)
+	}
+	if res.Answer[1].Header().Ttl != 300 {
+		t.Errorf("The original TTLs should be kept")
+	}
+
+	// the record of the smallest TTL expired a day ago
+	c.backend.Set(key, cacheEntry{putin: now.Add(-24*time.Hour - 300*time.Second), expire: now.Add(-24 * time.Hour), reply: res})
+	if cached, _ := c.lookup(q, true, nil, "udp"); cached != nil {
+		t.Errorf("Expired answer should not be served, got %v", cached)
+	}
+}
+
+func TestRequestToStringEDNS(t *testing.T) {
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	newOPT := func(do bool, subnet string) *dns.OPT {
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		if do {
+			opt.SetDo()
+		}
+		if subnet != "" {
+			ecs, _ := parseECS(subnet)
+			opt.Option = append(opt.Option, ecs)
+		}
+		return opt
+	}
+
+	plain := requestToString(q, true, nil, "udp")
+	if requestToString(q, true, newOPT(false, ""), "udp") != plain {
+		t.Errorf("EDNS without DO and client subnet should share the answer")
+	}
+	if requestToString(q, true, newOPT(true, ""), "udp") == plain {
+		t.Errorf("DO should be part of the key")
+	}
+	if requestToString(q, true, newOPT(false, "198.51.100.7/24"), "udp") != plain {
+		t.Errorf("The client subnet should not be part of the key, the scope of the answer decides")
+	}
+}
+
+func TestCacheECSScope(t *testing.T) {
+	q := dns.Question{Name: "cdn.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	newOPT := func(subnet string) *dns.OPT {
+		ecs, _ := parseECS(subnet)
+		return &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}, Option: []dns.EDNS0{ecs}}
+	}
+	// newAnswer returns the answer to the client subnet `subnet` of scope `scope`, or without ECS if negative
+	newAnswer := func(ip string, subnet string, scope int) *dns.Msg {
+		res := &dns.Msg{}
+		res.SetQuestion(q.Name, q.Qtype)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP(ip),
+		})
+		if scope >= 0 {
+			opt := newOPT(subnet)
+			findECS(opt).SourceScope = uint8(scope)
+			res.Extra = append(res.Extra, opt)
+		}
+		return res
+	}
+	lookup := func(c *dnsCache, subnet string) string {
+		res, _ := c.lookup(q, true, newOPT(subnet), "udp")
+		if res == nil {
+			return ""
+		}
+		return res.Answer[0].(*dns.A).A.String()
+	}
+
+	// the answer of scope 0 is shared by all the clients
+	c := newDNSCache(16)
+	c.set(newAnswer("192.0.2.1", "198.51.100.7/24", 0), newOPT("198.51.100.7/24"), "udp")
+	for _, subnet := range []string{"198.51.100.9/24", "203.0.113.7/24"} {
+		if got := lookup(c, subnet); got != "192.0.2.1" {
+			t.Errorf("%s should share the answer of scope 0, got %q", subnet, got)
+		}
+	}
+	if res, _ := c.lookup(q, true, nil, "udp"); res == nil {
+		t.Errorf("The client without subnet should share the answer of scope 0")
+	}
+
+	// the answer of scope 16 is shared by the clients in the same /16
+	c = newDNSCache(16)
+	c.set(newAnswer("192.0.2.1", "198.51.100.7/24", 16), newOPT("198.51.100.7/24"), "udp")
+	c.set(newAnswer("192.0.2.2", "203.0.113.7/24", 16), newOPT("203.0.113.7/24"), "udp")
+	tests := []struct {
+		subnet string
+		want   string
+	}{
+		{"198.51.100.9/24", "192.0.2.1"},
+		{"198.51.7.1/24", "192.0.2.1"},
+		{"203.0.113.9/24", "192.0.2.2"},
+		{"192.0.2.9/24", ""},
+	}
+	for _, tt := range tests {
+		if got := lookup(c, tt.subnet); got != tt.want {
+			t.Errorf("%s: expect %q, got %q", tt.subnet, tt.want, got)
+		}
+	}
+
+	// the answer to the subnet sent instead of the one of the client is shared by all the clients
+	c = newDNSCache(16)
+	c.set(newAnswer("192.0.2.3", "192.0.2.0/24", 24), newOPT("198.51.100.7/24"), "udp")
+	if got := lookup(c, "203.0.113.7/24"); got != "192.0.2.3" {
+		t.Errorf("The answer to the configured subnet should be shared, got %q", got)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	newNegative := func(name string, rcode int, soaTTL uint32, minTTL uint32) *dns.Msg {
+		res := &dns.Msg{}
+		res.SetQuestion(name, dns.TypeA)
+		res.Rcode = rcode
+		res.Ns = append(res.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: soaTTL},
+			Ns:     "ns.example.com.",
+			Mbox:   "admin.example.com.",
+			Minttl: minTTL,
+		})
+		return res
+	}
+
+	c := newDNSCache(10)
+	c.negativeTTL = 100 * time.Second
+	tests := []struct {
+		res *dns.Msg
+		ttl uint32
+	}{
+		{newNegative("nx.example.com.", dns.RcodeNameError, 3600, 60), 60},
+		{newNegative("nodata.example.com.", dns.RcodeSuccess, 30, 60), 30},
+		{newNegative("capped.example.com.", dns.RcodeNameError, 3600, 3600), 100},
+	}
+	for _, tt := range tests {
+		if !cacheable(tt.res) {
+			t.Errorf("%s should be cacheable", tt.res.Question[0].Name)
+		}
+		c.set(tt.res, nil, "udp")
+		res, upd := c.lookup(tt.res.Question[0], true, nil, "udp")
+		if res == nil || upd || res.Rcode != tt.res.Rcode {
+			t.Errorf("%s should be cached, got %v", tt.res.Question[0].Name, res)
+			continue
+		}
+		if ttl := res.Ns[0].Header().Ttl; ttl != tt.ttl {
+			t.Errorf("%s should be cached for %d seconds, got %d", tt.res.Question[0].Name, tt.ttl, ttl)
+		}
+	}
+
+	// without SOA, how long to cache is unknown
+	res := newNegative("nosoa.example.com.", dns.RcodeNameError, 60, 60)
+	res.Ns = nil
+	c.set(res, nil, "udp")
+	if res, _ := c.lookup(res.Question[0], true, nil, "udp"); res != nil {
+		t.Errorf("Negative answer without SOA should not be cached")
+	}
+
+	res = newNegative("truncated.example.com.", dns.RcodeSuccess, 60, 60)
+	res.Truncated = true
+	if cacheable(res) {
+		t.Errorf("Truncated answer should not be cacheable")
+	}
+	res = newNegative("servfail.example.com.", dns.RcodeServerFailure, 60, 60)
+	if cacheable(res) {
+		t.Errorf("SERVFAIL should not be cacheable")
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	res := &dns.Msg{}
+	res.SetQuestion("example.com.", dns.TypeA)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+		A:   net.IPv4(127, 0, 0, 1),
+	})
+	q := res.Question[0]
+
+	c := newDNSCache(10)
+	c.set(res, nil, "udp")
+	time.Sleep(10 * time.Millisecond)
+	if cached, upd := c.lookup(q, true, nil, "udp"); cached != nil || !upd {
+		t.Errorf("Expired answer should not be served")
+	}
+	if c.lookupStale(q, true, nil, "udp") != nil {
+		t.Errorf("Nothing should be stale without the stale window")
+	}
+
+	c = newDNSCache(10)
+	c.staleWindow = time.Hour
+	c.set(res, nil, "udp")
+	time.Sleep(10 * time.Millisecond)
+	if cached, upd := c.lookup(q, true, nil, "udp"); cached != nil || !upd {
+		t.Errorf("Expired answer should be asked again")
+	}
+	stale := c.lookupStale(q, true, nil, "udp")
+	if stale == nil || stale.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Errorf("Expect stale answer with TTL %d, got %v", staleAnswerTTL, stale)
+	}
+
+	// expired too long ago
+	c.backend.Set(requestToString(q, true, nil, "udp"), cacheEntry{
+		putin:  time.Now().Add(-2 * time.Hour),
+		expire: time.Now().Add(-2 * time.Hour),
+		reply:  res,
+	})
+	if c.lookupStale(q, true, nil, "udp") != nil {
+		t.Errorf("Answer expired out of the stale window should not be served")
+	}
+}
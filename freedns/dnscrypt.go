@@ -0,0 +1,343 @@
+package freedns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	dnscryptTimeout = 2 * time.Second
+	// Certificates are fetched again after this, in case the resolver rotated its keys.
+	dnscryptCertRefresh = time.Hour
+
+	dnscryptStampProtocol = 0x01
+	dnscryptDefaultPort   = "443"
+	dnscryptESVersion     = 0x0001 // X25519-XSalsa20Poly1305
+
+	dnscryptClientNonceSize = 12
+	dnscryptNonceSize       = 24
+	dnscryptMinQuerySize    = 256
+	dnscryptPadBlockSize    = 64
+)
+
+var (
+	dnscryptCertMagic     = []byte("DNSC")
+	dnscryptResolverMagic = []byte("r6fnvWj8")
+)
+
+// dnscryptStamp is the decoded form of a sdns:// stamp of a DNSCrypt server.
+type dnscryptStamp struct {
+	addr         string
+	providerPK   ed25519.PublicKey
+	providerName string
+}
+
+// dnscryptCert is a verified certificate of a DNSCrypt resolver.
+type dnscryptCert struct {
+	resolverPK  [32]byte
+	clientMagic [8]byte
+	serial      uint32
+	notAfter    time.Time
+}
+
+// dnscryptTransport speaks the DNSCrypt v2 protocol.
+// Only the X25519-XSalsa20Poly1305 construction is supported.
+type dnscryptTransport struct {
+	stamp  dnscryptStamp
+	dialer dialer
+
+	mu        sync.Mutex
+	cert      *dnscryptCert
+	fetchedAt time.Time
+	publicKey *[32]byte
+	sharedKey *[32]byte
+}
+
+// parseDNSCryptStamp decodes a sdns:// stamp, see https://dnscrypt.info/stamps-specifications
+func parseDNSCryptStamp(stamp string) (dnscryptStamp, error) {
+	invalid := Error("Invalid DNSCrypt stamp " + stamp)
+	if !strings.HasPrefix(stamp, "sdns://") {
+		return dnscryptStamp{}, invalid
+	}
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(stamp[len("sdns://"):], "="))
+	if err != nil || len(bin) < 9 || bin[0] != dnscryptStampProtocol {
+		return dnscryptStamp{}, invalid
+	}
+
+	// skip the protocol and the 8 bytes of properties
+	rest := bin[9:]
+	readLP := func() ([]byte, bool) {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, false
+		}
+		v := rest[1 : 1+int(rest[0])]
+		rest = rest[1+int(rest[0]):]
+		return v, true
+	}
+	addr, ok1 := readLP()
+	pk, ok2 := readLP()
+	name, ok3 := readLP()
+	if !ok1 || !ok2 || !ok3 || len(pk) != ed25519.PublicKeySize || len(name) == 0 {
+		return dnscryptStamp{}, invalid
+	}
+
+	s := dnscryptStamp{
+		providerPK:   ed25519.PublicKey(pk),
+		providerName: dns.Fqdn(string(name)),
+	}
+	if s.addr, err = normalizeAddress(string(addr), dnscryptDefaultPort); err != nil {
+		return dnscryptStamp{}, invalid
+	}
+	return s, nil
+}
+
+func newDNSCryptTransport(stamp string, d dialer) (*dnscryptTransport, error) {
+	s, err := parseDNSCryptStamp(stamp)
+	if err != nil {
+		return nil, err
+	}
+	return &dnscryptTransport{stamp: s, dialer: d}, nil
+}
+
+// close does nothing, every query uses a new connection.
+func (t *dnscryptTransport) close() {}
+
+func (t *dnscryptTransport) exchange(ctx context.Context, req *dns.Msg, net string) (*dns.Msg, time.Duration, error) {
+	cert, publicKey, sharedKey, err := t.getCert(ctx, net)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	res, err := dnscryptExchange(ctx, t.dialer, req, net, t.stamp.addr, cert, publicKey, sharedKey)
+	if err == nil && res.Truncated && net == "udp" {
+		res, err = dnscryptExchange(ctx, t.dialer, req, "tcp", t.stamp.addr, cert, publicKey, sharedKey)
+	}
+	if err != nil {
+		return nil, 0, contextError(ctx, err)
+	}
+	return res, time.Since(start), nil
+}
+
+// getCert returns the current certificate with the keys derived for it,
+// and fetches a new one if needed.
+func (t *dnscryptTransport) getCert(ctx context.Context, net string) (*dnscryptCert, *[32]byte, *[32]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if t.cert != nil && now.Before(t.cert.notAfter) && now.Sub(t.fetchedAt) < dnscryptCertRefresh {
+		return t.cert, t.publicKey, t.sharedKey, nil
+	}
+
+	cert, err := fetchDNSCryptCert(ctx, t.dialer, t.stamp, net)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sharedKey := &[32]byte{}
+	box.Precompute(sharedKey, &cert.resolverPK, privateKey)
+
+	t.cert, t.fetchedAt = cert, now
+	t.publicKey, t.sharedKey = publicKey, sharedKey
+	return cert, publicKey, sharedKey, nil
+}
+
+// fetchDNSCryptCert queries the certificates of the resolver, and returns the
+// valid one with the highest serial.
+func fetchDNSCryptCert(ctx context.Context, d dialer, stamp dnscryptStamp, net string) (*dnscryptCert, error) {
+	req := &dns.Msg{}
+	req.SetQuestion(stamp.providerName, dns.TypeTXT)
+	t := &plainTransport{addr: stamp.addr, dialer: d}
+	res, _, err := t.exchange(ctx, req, net)
+	if err == nil && res.Truncated && net == "udp" {
+		res, _, err = t.exchange(ctx, req, "tcp")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var best *dnscryptCert
+	for _, rr := range res.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		cert, err := parseDNSCryptCert(unescapeTXT(strings.Join(txt.Txt, "")), stamp.providerPK, time.Now())
+		if err != nil {
+			log.WithField("provider", stamp.providerName).WithField("error", err).Warn("Ignore DNSCrypt certificate")
+			continue
+		}
+		if best == nil || cert.serial > best.serial {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, Error("No valid DNSCrypt certificate from " + stamp.providerName)
+	}
+	return best, nil
+}
+
+// parseDNSCryptCert parses and verifies a certificate, which is laid out as
+// magic(4) es-version(2) minor-version(2) signature(64)
+// resolver-pk(32) client-magic(8) serial(4) ts-start(4) ts-end(4) [extensions]
+func parseDNSCryptCert(bin []byte, providerPK ed25519.PublicKey, now time.Time) (*dnscryptCert, error) {
+	if len(bin) < 124 || !bytes.Equal(bin[:4], dnscryptCertMagic) {
+		return nil, Error("Malformed DNSCrypt certificate")
+	}
+	if binary.BigEndian.Uint16(bin[4:6]) != dnscryptESVersion {
+		return nil, Error("Unsupported DNSCrypt encryption system")
+	}
+	signature, signed := bin[8:72], bin[72:]
+	if !ed25519.Verify(providerPK, signed, signature) {
+		return nil, Error("Bad DNSCrypt certificate signature")
+	}
+
+	cert := &dnscryptCert{}
+	copy(cert.resolverPK[:], signed[0:32])
+	copy(cert.clientMagic[:], signed[32:40])
+	cert.serial = binary.BigEndian.Uint32(signed[40:44])
+	notBefore := time.Unix(int64(binary.BigEndian.Uint32(signed[44:48])), 0)
+	cert.notAfter = time.Unix(int64(binary.BigEndian.Uint32(signed[48:52])), 0)
+	if now.Before(notBefore) || !now.Before(cert.notAfter) {
+		return nil, Error("DNSCrypt certificate is not valid now")
+	}
+	return cert, nil
+}
+
+// dnscryptExchange encrypts the query, sends it and decrypts the response.
+func dnscryptExchange(ctx context.Context, d dialer, req *dns.Msg, network string, addr string, cert *dnscryptCert, publicKey, sharedKey *[32]byte) (*dns.Msg, error) {
+	query, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [dnscryptNonceSize]byte
+	if _, err := rand.Read(nonce[:dnscryptClientNonceSize]); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 0, 8+32+dnscryptClientNonceSize+len(query)+dnscryptMinQuerySize+box.Overhead)
+	packet = append(packet, cert.clientMagic[:]...)
+	packet = append(packet, publicKey[:]...)
+	packet = append(packet, nonce[:dnscryptClientNonceSize]...)
+	packet = box.SealAfterPrecomputation(packet, dnscryptPad(query), &nonce, sharedKey)
+
+	conn, network, err := dialFallback(ctx, d, network, addr, dnscryptTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := interruptOnDone(ctx, conn, dnscryptTimeout)
+	defer stop()
+
+	var reply []byte
+	if network == "tcp" {
+		framed := make([]byte, 2, 2+len(packet))
+		binary.BigEndian.PutUint16(framed, uint16(len(packet)))
+		if _, err := conn.Write(append(framed, packet...)); err != nil {
+			return nil, err
+		}
+		var l [2]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		reply = make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		reply = buf[:n]
+	}
+
+	// resolver-magic(8) nonce(24) encrypted-response
+	if len(reply) < 8+dnscryptNonceSize+box.Overhead ||
+		!bytes.Equal(reply[:8], dnscryptResolverMagic) ||
+		!bytes.Equal(reply[8:8+dnscryptClientNonceSize], nonce[:dnscryptClientNonceSize]) {
+		return nil, Error("Malformed DNSCrypt response")
+	}
+	copy(nonce[:], reply[8:8+dnscryptNonceSize])
+	padded, ok := box.OpenAfterPrecomputation(nil, reply[8+dnscryptNonceSize:], &nonce, sharedKey)
+	if !ok {
+		return nil, Error("Cannot decrypt DNSCrypt response")
+	}
+	plain, err := dnscryptUnpad(padded)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &dns.Msg{}
+	if err := res.Unpack(plain); err != nil {
+		return nil, err
+	}
+	if res.Id != req.Id {
+		return nil, dns.ErrId
+	}
+	return res, nil
+}
+
+// dnscryptPad pads the message with 0x80 followed by zeros (ISO/IEC 7816-4)
+// to a multiple of 64 bytes, and to at least 256 bytes.
+func dnscryptPad(msg []byte) []byte {
+	size := (len(msg) + 1 + dnscryptPadBlockSize - 1) / dnscryptPadBlockSize * dnscryptPadBlockSize
+	if size < dnscryptMinQuerySize {
+		size = dnscryptMinQuerySize
+	}
+	padded := make([]byte, size)
+	copy(padded, msg)
+	padded[len(msg)] = 0x80
+	return padded
+}
+
+func dnscryptUnpad(padded []byte) ([]byte, error) {
+	i := bytes.LastIndexByte(padded, 0x80)
+	if i < 0 || len(bytes.Trim(padded[i+1:], "\x00")) != 0 {
+		return nil, Error("Invalid DNSCrypt padding")
+	}
+	return padded[:i], nil
+}
+
+// unescapeTXT reverts the escaping of non-printable bytes (\DDD) and
+// special characters (\X) applied to TXT strings by the dns package.
+func unescapeTXT(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b = append(b, (s[i+1]-'0')*100+(s[i+2]-'0')*10+(s[i+3]-'0'))
+			i += 3
+		} else {
+			b = append(b, s[i+1])
+			i++
+		}
+	}
+	return b
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,194 @@
+package freedns
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// dnscryptStandIn is a minimal DNSCrypt server over UDP which answers
+// every query with 127.0.0.1.
+type dnscryptStandIn struct {
+	conn         net.PacketConn
+	providerName string
+	providerPK   ed25519.PublicKey
+	cert         []byte
+	clientMagic  []byte
+	resolverSK   *[32]byte
+}
+
+func newDNSCryptStandIn(t *testing.T) *dnscryptStandIn {
+	providerPK, providerSK, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolverPK, resolverSK, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnscryptStandIn{
+		conn:         conn,
+		providerName: "2.dnscrypt-cert.example.com.",
+		providerPK:   providerPK,
+		clientMagic:  []byte("clntmgc1"),
+		resolverSK:   resolverSK,
+	}
+
+	signed := make([]byte, 0, 52)
+	signed = append(signed, resolverPK[:]...)
+	signed = append(signed, s.clientMagic...)
+	var ts [12]byte
+	binary.BigEndian.PutUint32(ts[0:4], 1)
+	binary.BigEndian.PutUint32(ts[4:8], uint32(time.Now().Add(-time.Hour).Unix()))
+	binary.BigEndian.PutUint32(ts[8:12], uint32(time.Now().Add(time.Hour).Unix()))
+	signed = append(signed, ts[:]...)
+
+	s.cert = append([]byte("DNSC\x00\x01\x00\x00"), ed25519.Sign(providerSK, signed)...)
+	s.cert = append(s.cert, signed...)
+
+	go s.serve()
+	return s
+}
+
+// stamp returns the sdns:// stamp of the server.
+func (s *dnscryptStandIn) stamp() string {
+	addr := s.conn.LocalAddr().String()
+	name := strings.TrimSuffix(s.providerName, ".")
+	bin := []byte{dnscryptStampProtocol, 0, 0, 0, 0, 0, 0, 0, 0}
+	bin = append(bin, byte(len(addr)))
+	bin = append(bin, addr...)
+	bin = append(bin, byte(len(s.providerPK)))
+	bin = append(bin, s.providerPK...)
+	bin = append(bin, byte(len(name)))
+	bin = append(bin, name...)
+	return "sdns://" + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func (s *dnscryptStandIn) serve() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		packet := buf[:n]
+		if bytes.HasPrefix(packet, s.clientMagic) {
+			s.conn.WriteTo(s.answerEncrypted(packet), addr)
+		} else {
+			s.conn.WriteTo(s.answerCert(packet), addr)
+		}
+	}
+}
+
+// answerCert answers the plain TXT query of the certificate.
+func (s *dnscryptStandIn) answerCert(packet []byte) []byte {
+	req := &dns.Msg{}
+	if req.Unpack(packet) != nil {
+		return nil
+	}
+	res := &dns.Msg{}
+	res.SetReply(req)
+	escaped := ""
+	for _, b := range s.cert {
+		escaped += fmt.Sprintf("\\%03d", b)
+	}
+	res.Answer = append(res.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: s.providerName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{escaped},
+	})
+	out, _ := res.Pack()
+	return out
+}
+
+func (s *dnscryptStandIn) answerEncrypted(packet []byte) []byte {
+	var clientPK [32]byte
+	var nonce [dnscryptNonceSize]byte
+	copy(clientPK[:], packet[8:40])
+	copy(nonce[:], packet[40:40+dnscryptClientNonceSize])
+
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, &clientPK, s.resolverSK)
+	padded, ok := box.OpenAfterPrecomputation(nil, packet[40+dnscryptClientNonceSize:], &nonce, &sharedKey)
+	if !ok {
+		return nil
+	}
+	query, err := dnscryptUnpad(padded)
+	if err != nil {
+		return nil
+	}
+	req := &dns.Msg{}
+	if req.Unpack(query) != nil {
+		return nil
+	}
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(127, 0, 0, 1),
+	})
+	out, _ := res.Pack()
+
+	rand.Read(nonce[dnscryptClientNonceSize:])
+	reply := append([]byte{}, dnscryptResolverMagic...)
+	reply = append(reply, nonce[:]...)
+	return box.SealAfterPrecomputation(reply, dnscryptPad(out), &nonce, &sharedKey)
+}
+
+func TestDNSCryptStamp(t *testing.T) {
+	s := newDNSCryptStandIn(t)
+	defer s.conn.Close()
+
+	stamp, err := parseDNSCryptStamp(s.stamp())
+	if err != nil {
+		t.Errorf("Cannot parse stamp: %s", err.Error())
+		return
+	}
+	if stamp.addr != s.conn.LocalAddr().String() || stamp.providerName != s.providerName || !bytes.Equal(stamp.providerPK, s.providerPK) {
+		t.Errorf("Bad parse result %v", stamp)
+	}
+
+	for _, name := range []string{"sdns://", "sdns://AQ", "sdns://" + base64.RawURLEncoding.EncodeToString([]byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0})} {
+		if _, err := newUpstreamProvider(name, upstreamOptions{}); err == nil {
+			t.Errorf("Should not create provider for %s", name)
+		}
+	}
+}
+
+func TestDNSCryptResolve(t *testing.T) {
+	s := newDNSCryptStandIn(t)
+	defer s.conn.Close()
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for i := 0; i < 2; i++ {
+		res, _, err := naiveResolve(context.Background(), q, true, "udp", s.stamp())
+		if err != nil {
+			t.Errorf("DNSCrypt resolve failed: %s", err.Error())
+		} else if len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Errorf("DNSCrypt resolve got wrong answer %v", res)
+		}
+	}
+
+	// a certificate signed by another provider must be rejected
+	otherPK, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := parseDNSCryptCert(s.cert, otherPK, time.Now()); err == nil {
+		t.Errorf("Certificate with bad signature should be rejected")
+	}
+	if _, err := parseDNSCryptCert(s.cert, s.providerPK, time.Now().Add(2*time.Hour)); err == nil {
+		t.Errorf("Expired certificate should be rejected")
+	}
+}
@@ -0,0 +1,521 @@
+package freedns
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootTrustAnchors are the DS records of the root key signing keys, KSK-2017 and KSK-2024,
+// as published by IANA at https://data.iana.org/root-anchors/root-anchors.xml.
+const rootTrustAnchors = `
+. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+. IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16
+`
+
+const (
+	// the validated keys are trusted for at most their TTL, but not shorter than dnssecMinTTL
+	dnssecMinTTL = time.Minute
+	// the number of zones whose keys are cached
+	dnssecMaxZones = 4096
+)
+
+// errDNSSECBogus means the answer fails the DNSSEC validation, i.e. it is forged or broken.
+const errDNSSECBogus = Error("DNSSEC validation failed")
+
+// dnssecResult is the outcome of the DNSSEC validation of an answer.
+type dnssecResult int
+
+const (
+	// the answer is from a zone which is not signed, nothing can be told
+	dnssecInsecure dnssecResult = iota
+	// the answer is proven authentic by the chain of trust
+	dnssecSecure
+	// the answer should be signed, but the signatures are missing or invalid
+	dnssecBogus
+	// the DS or DNSKEY records cannot be fetched, e.g. the upstream times out,
+	// so nothing can be told this time
+	dnssecIndeterminate
+)
+
+func (r dnssecResult) String() string {
+	switch r {
+	case dnssecSecure:
+		return "secure"
+	case dnssecBogus:
+		return "bogus"
+	case dnssecIndeterminate:
+		return "indeterminate"
+	}
+	return "insecure"
+}
+
+// dnssecQuery asks an upstream for `q` with the DO bit set.
+type dnssecQuery func(ctx context.Context, q dns.Question) (*dns.Msg, error)
+
+// dnssecValidator validates the answers by the chain of trust from the trust anchors:
+// the keys of a zone are trusted if they are signed by a key matching the DS records,
+// which are signed by the trusted keys of the parent zone, up to the trust anchors.
+// The DS and DNSKEY records are fetched by `query`, and the trusted keys are cached.
+//
+// The signatures of the denial of existence (NSEC and NSEC3) are validated, and
+// they must cover or match the queried name, but the closest encloser and
+// the wildcard proofs are not checked.
+type dnssecValidator struct {
+	// DS records of the trust anchors, by zone
+	anchors map[string][]*dns.DS
+	query   dnssecQuery
+
+	mu    sync.Mutex
+	zones map[string]*zoneTrust
+}
+
+// zoneTrust is the validated keys of a zone, or the proof that the zone is not signed.
+type zoneTrust struct {
+	keys     []*dns.DNSKEY
+	insecure bool
+	expire   time.Time
+}
+
+// newDNSSECValidator reads the trust anchors, DS or DNSKEY records in zone file format,
+// from `filename`, or uses the root trust anchors if it is empty.
+func newDNSSECValidator(filename string, query dnssecQuery) (*dnssecValidator, error) {
+	v := &dnssecValidator{
+		anchors: make(map[string][]*dns.DS),
+		query:   query,
+		zones:   make(map[string]*zoneTrust),
+	}
+
+	var zp *dns.ZoneParser
+	if filename == "" {
+		zp = dns.NewZoneParser(strings.NewReader(rootTrustAnchors), ".", "")
+	} else {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		zp = dns.NewZoneParser(f, ".", filename)
+	}
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		var ds *dns.DS
+		switch rr := rr.(type) {
+		case *dns.DS:
+			ds = rr
+		case *dns.DNSKEY:
+			ds = rr.ToDS(dns.SHA256)
+		default:
+			continue
+		}
+		zone := strings.ToLower(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(v.anchors) == 0 {
+		return nil, Error("No trust anchor found in " + filename)
+	}
+	return v, nil
+}
+
+// validate validates the answer and the authority sections of `res`, the answer to `q`.
+func (v *dnssecValidator) validate(ctx context.Context, q dns.Question, res *dns.Msg) dnssecResult {
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return dnssecInsecure
+	}
+
+	sets, sigs := groupRRsets(res.Answer)
+	result := dnssecSecure
+	for key, rrset := range sets {
+		result = worse(result, v.validateRRset(ctx, rrset, sigs[key]))
+	}
+
+	// the denial of existence, or the authority of a positive answer
+	nsSets, nsSigs := groupRRsets(res.Ns)
+	denial := len(res.Answer) == 0
+	proved := false
+	for key, rrset := range nsSets {
+		// the NS records of a referral are not signed by the parent
+		if rrset[0].Header().Rrtype == dns.TypeNS && len(nsSigs[key]) == 0 {
+			continue
+		}
+		r := v.validateRRset(ctx, rrset, nsSigs[key])
+		result = worse(result, r)
+		if r == dnssecSecure && denial && deniesName(rrset, q) {
+			proved = true
+		}
+	}
+
+	if denial {
+		if len(nsSets) == 0 {
+			// nothing is signed, it is fine only if the zone is not signed
+			result = v.validateUnsigned(ctx, q.Name)
+		} else if result == dnssecSecure && !proved {
+			result = dnssecBogus
+		}
+	}
+	return result
+}
+
+// worse returns the worse of the two results, bogus is worse than indeterminate,
+// which is worse than insecure, which is worse than secure.
+func worse(a dnssecResult, b dnssecResult) dnssecResult {
+	if a == dnssecBogus || b == dnssecBogus {
+		return dnssecBogus
+	}
+	if a == dnssecIndeterminate || b == dnssecIndeterminate {
+		return dnssecIndeterminate
+	}
+	if a == dnssecInsecure || b == dnssecInsecure {
+		return dnssecInsecure
+	}
+	return dnssecSecure
+}
+
+// validateRRset validates `rrset` by any of its signatures `sigs`.
+func (v *dnssecValidator) validateRRset(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG) dnssecResult {
+	owner := rrset[0].Header().Name
+	if len(sigs) == 0 {
+		return v.validateUnsigned(ctx, owner)
+	}
+
+	result := dnssecBogus
+	for _, sig := range sigs {
+		// a zone only signs the names in it
+		if !dns.IsSubDomain(sig.SignerName, owner) {
+			continue
+		}
+		keys, insecure, err := v.zoneKeys(ctx, sig.SignerName)
+		if err != nil {
+			// failing to fetch the keys proves nothing, unlike the keys failing the validation
+			if err != errDNSSECBogus && result == dnssecBogus {
+				result = dnssecIndeterminate
+			}
+			continue
+		}
+		if insecure {
+			result = dnssecInsecure
+			continue
+		}
+		if verifyRRset(rrset, []*dns.RRSIG{sig}, keys) {
+			return dnssecSecure
+		}
+	}
+	return result
+}
+
+// validateUnsigned checks if `name` is in a zone which is not signed.
+func (v *dnssecValidator) validateUnsigned(ctx context.Context, name string) dnssecResult {
+	_, insecure, err := v.zoneKeys(ctx, name)
+	if err != nil && err != errDNSSECBogus {
+		return dnssecIndeterminate
+	}
+	if err == nil && insecure {
+		return dnssecInsecure
+	}
+	return dnssecBogus
+}
+
+// zoneKeys returns the trusted keys of the zone `name` is in, or true if the zone is not signed.
+// It returns errDNSSECBogus if the keys fail the validation, or the error of fetching them,
+// which is not cached.
+func (v *dnssecValidator) zoneKeys(ctx context.Context, name string) ([]*dns.DNSKEY, bool, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	v.mu.Lock()
+	t, ok := v.zones[name]
+	v.mu.Unlock()
+	if ok && time.Now().Before(t.expire) {
+		return t.keys, t.insecure, nil
+	}
+
+	t, err := v.fetchZoneKeys(ctx, name)
+	if err != nil {
+		return nil, false, err
+	}
+	v.mu.Lock()
+	if len(v.zones) >= dnssecMaxZones {
+		v.zones = make(map[string]*zoneTrust)
+	}
+	v.zones[name] = t
+	v.mu.Unlock()
+	return t.keys, t.insecure, nil
+}
+
+func (v *dnssecValidator) fetchZoneKeys(ctx context.Context, name string) (*zoneTrust, error) {
+	ttl := uint32(0)
+	ds, ok := v.anchors[name]
+	if !ok {
+		if name == "." {
+			// the trust anchors are given for some zones only, the others cannot be validated
+			return &zoneTrust{insecure: true, expire: expireAfter(0)}, nil
+		}
+		res, err := v.query(ctx, dns.Question{Name: name, Qtype: dns.TypeDS, Qclass: dns.ClassINET})
+		if err != nil {
+			return nil, err
+		}
+		sets, sigs := groupRRsets(res.Answer)
+		key := rrsetKey(name, dns.TypeDS)
+		if rrset := sets[key]; len(rrset) > 0 {
+			// the DS records are signed by the parent zone
+			parent := ""
+			if len(sigs[key]) > 0 {
+				parent = sigs[key][0].SignerName
+			}
+			if parent == "" || strings.EqualFold(parent, name) || !dns.IsSubDomain(parent, name) {
+				return nil, errDNSSECBogus
+			}
+			keys, insecure, err := v.zoneKeys(ctx, parent)
+			if err != nil {
+				return nil, err
+			}
+			if insecure {
+				return &zoneTrust{insecure: true, expire: expireAfter(0)}, nil
+			}
+			if !verifyRRset(rrset, sigs[key], keys) {
+				return nil, errDNSSECBogus
+			}
+			for _, rr := range rrset {
+				ds = append(ds, rr.(*dns.DS))
+			}
+			ttl = rrset[0].Header().Ttl
+		} else {
+			return v.fetchParentTrust(ctx, name, res)
+		}
+	}
+
+	res, err := v.query(ctx, dns.Question{Name: name, Qtype: dns.TypeDNSKEY, Qclass: dns.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	sets, sigs := groupRRsets(res.Answer)
+	key := rrsetKey(name, dns.TypeDNSKEY)
+	rrset := sets[key]
+	var keys []*dns.DNSKEY
+	for _, rr := range rrset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	// the DNSKEY records must be signed by a key matching the DS records
+	var entrypoints []*dns.DNSKEY
+	for _, k := range keys {
+		for _, d := range ds {
+			if k.KeyTag() == d.KeyTag && k.Algorithm == d.Algorithm {
+				if kds := k.ToDS(d.DigestType); kds != nil && strings.EqualFold(kds.Digest, d.Digest) {
+					entrypoints = append(entrypoints, k)
+				}
+			}
+		}
+	}
+	if len(entrypoints) == 0 || !verifyRRset(rrset, sigs[key], entrypoints) {
+		return nil, errDNSSECBogus
+	}
+	if ttl == 0 || rrset[0].Header().Ttl < ttl {
+		ttl = rrset[0].Header().Ttl
+	}
+	return &zoneTrust{keys: keys, expire: expireAfter(ttl)}, nil
+}
+
+// fetchParentTrust decides by `res`, the answer to the DS query of `name` which has no DS records,
+// whether `name` is an unsigned delegation, or just a name in the parent zone.
+func (v *dnssecValidator) fetchParentTrust(ctx context.Context, name string, res *dns.Msg) (*zoneTrust, error) {
+	sets, sigs := groupRRsets(res.Ns)
+	var parent string
+	for _, rrsigs := range sigs {
+		if len(rrsigs) > 0 {
+			parent = rrsigs[0].SignerName
+			break
+		}
+	}
+	if parent == "" || strings.EqualFold(parent, name) || !dns.IsSubDomain(parent, name) {
+		// the denial is not signed, it is fine only if the parent is not signed
+		labels := dns.SplitDomainName(name)
+		parent = dns.Fqdn(strings.Join(labels[1:], "."))
+		keys, insecure, err := v.zoneKeys(ctx, parent)
+		if err != nil {
+			return nil, err
+		}
+		if !insecure {
+			return nil, errDNSSECBogus
+		}
+		return &zoneTrust{keys: keys, insecure: true, expire: expireAfter(0)}, nil
+	}
+
+	keys, insecure, err := v.zoneKeys(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+	if insecure {
+		return &zoneTrust{insecure: true, expire: expireAfter(0)}, nil
+	}
+	delegation := false
+	for key, rrset := range sets {
+		t := rrset[0].Header().Rrtype
+		if t != dns.TypeNSEC && t != dns.TypeNSEC3 && t != dns.TypeSOA {
+			continue
+		}
+		if !verifyRRset(rrset, sigs[key], keys) {
+			return nil, errDNSSECBogus
+		}
+		for _, rr := range rrset {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if strings.EqualFold(rr.Hdr.Name, name) {
+					if hasType(rr.TypeBitMap, dns.TypeDS) {
+						return nil, errDNSSECBogus
+					}
+					delegation = hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA)
+				}
+			case *dns.NSEC3:
+				if rr.Match(name) {
+					if hasType(rr.TypeBitMap, dns.TypeDS) {
+						return nil, errDNSSECBogus
+					}
+					delegation = hasType(rr.TypeBitMap, dns.TypeNS) && !hasType(rr.TypeBitMap, dns.TypeSOA)
+				} else if rr.Cover(name) && rr.Flags&1 == 1 {
+					// opt-out, the unsigned delegations are not listed
+					delegation = true
+				}
+			}
+		}
+	}
+	if delegation {
+		return &zoneTrust{insecure: true, expire: expireAfter(0)}, nil
+	}
+	// not a zone cut, `name` is in the parent zone
+	return &zoneTrust{keys: keys, expire: expireAfter(0)}, nil
+}
+
+func expireAfter(ttl uint32) time.Time {
+	d := time.Duration(ttl) * time.Second
+	if d < dnssecMinTTL {
+		d = dnssecMinTTL
+	}
+	return time.Now().Add(d)
+}
+
+// verifyRRset returns whether `rrset` is signed by any of `keys` with any of `sigs`.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) bool {
+	now := time.Now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm || !strings.EqualFold(k.Hdr.Name, sig.SignerName) {
+				continue
+			}
+			if sig.Verify(k, rrset) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func rrsetKey(name string, rrtype uint16) string {
+	return strings.ToLower(name) + " " + dns.TypeToString[rrtype]
+}
+
+// groupRRsets groups `rrs` by owner and type, and the signatures by owner and the type covered.
+func groupRRsets(rrs []dns.RR) (map[string][]dns.RR, map[string][]*dns.RRSIG) {
+	sets := make(map[string][]dns.RR)
+	sigs := make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			key := rrsetKey(rr.Hdr.Name, rr.TypeCovered)
+			sigs[key] = append(sigs[key], rr)
+		case *dns.OPT:
+		default:
+			key := rrsetKey(rr.Header().Name, rr.Header().Rrtype)
+			sets[key] = append(sets[key], rr)
+		}
+	}
+	return sets, sigs
+}
+
+// deniesName returns whether the NSEC or NSEC3 records in `rrset` prove `q` does not exist,
+// either the name (covered) or the type (matched without it).
+func deniesName(rrset []dns.RR, q dns.Question) bool {
+	for _, rr := range rrset {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(rr.Hdr.Name, q.Name) {
+				if !hasType(rr.TypeBitMap, q.Qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+			} else if nsecCovers(rr, q.Name) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Match(q.Name) {
+				if !hasType(rr.TypeBitMap, q.Qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+					return true
+				}
+			} else if rr.Cover(q.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// nsecCovers returns whether `name` is between the owner and the next name of `nsec`.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	if !canonicalLess(nsec.Hdr.Name, name) {
+		return false
+	}
+	// the last NSEC of a zone points back to the apex
+	return canonicalLess(name, nsec.NextDomain) || !canonicalLess(nsec.Hdr.Name, nsec.NextDomain)
+}
+
+// canonicalLess compares the domains in the canonical order defined in RFC 4034 section 6.1.
+func canonicalLess(a string, b string) bool {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		x, y := la[len(la)-i], lb[len(lb)-i]
+		if x != y {
+			return x < y
+		}
+	}
+	return len(la) < len(lb)
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+// stripDNSSEC removes the DNSSEC records, which the client does not ask for by the DO bit,
+// unless they are of the queried type.
+func stripDNSSEC(res *dns.Msg) {
+	var qtype uint16
+	if len(res.Question) > 0 {
+		qtype = res.Question[0].Qtype
+	}
+	strip := func(rrs []dns.RR) []dns.RR {
+		kept := rrs[:0]
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		return kept
+	}
+	res.Answer = strip(res.Answer)
+	res.Ns = strip(res.Ns)
+	res.Extra = strip(res.Extra)
+}
@@ -0,0 +1,341 @@
+package freedns
+
+import (
+	"context"
+	"crypto"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZones is a signed hierarchy served by a stand-in upstream:
+//
+//	.               signed, the trust anchor
+//	test.           signed, delegated from the root with a DS record
+//	plain.test.     not signed, delegated from test. without DS records
+type testZones struct {
+	keys     map[string]*dns.DNSKEY
+	privates map[string]crypto.Signer
+	// answers and denials by rrsetKey
+	answers map[string][]dns.RR
+	denials map[string][]dns.RR
+}
+
+func newTestZones(t *testing.T) *testZones {
+	z := &testZones{
+		keys:     make(map[string]*dns.DNSKEY),
+		privates: make(map[string]crypto.Signer),
+		answers:  make(map[string][]dns.RR),
+		denials:  make(map[string][]dns.RR),
+	}
+	for _, zone := range []string{".", "test."} {
+		k := &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     257,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := k.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.keys[zone], z.privates[zone] = k, priv.(crypto.Signer)
+		z.addSigned(t, zone, k)
+	}
+
+	ds := z.keys["test."].ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	z.addSigned(t, ".", ds)
+	z.addSigned(t, "test.", newTestRR(t, "www.test. 3600 IN A 127.0.0.1"))
+	z.add(newTestRR(t, "www.plain.test. 3600 IN A 127.0.0.2"))
+
+	// plain.test. is a delegation without DS records
+	z.deny(t, "plain.test.", dns.TypeDS, "test.", newTestRR(t, "plain.test. 3600 IN NSEC www.test. NS RRSIG NSEC"))
+	// the DS query of www.plain.test. is answered by plain.test., which is not signed
+	z.denials[rrsetKey("www.plain.test.", dns.TypeDS)] = []dns.RR{
+		newTestRR(t, "plain.test. 3600 IN SOA ns.plain.test. admin.plain.test. 1 3600 600 86400 60"),
+	}
+	// nothing between test. and plain.test., e.g. nx.test. and forged.test.
+	z.deny(t, "", 0, "test.", newTestRR(t, "test. 3600 IN NSEC plain.test. SOA NS RRSIG NSEC DNSKEY"))
+	return z
+}
+
+func newTestRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func (z *testZones) sign(t *testing.T, zone string, rrset ...dns.RR) *dns.RRSIG {
+	k := z.keys[zone]
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  k.Algorithm,
+		Expiration: uint32(time.Now().Add(24 * time.Hour).Unix()),
+		Inception:  uint32(time.Now().Add(-24 * time.Hour).Unix()),
+		KeyTag:     k.KeyTag(),
+		SignerName: zone,
+	}
+	if err := sig.Sign(z.privates[zone], rrset); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func (z *testZones) add(rrs ...dns.RR) {
+	key := rrsetKey(rrs[0].Header().Name, rrs[0].Header().Rrtype)
+	z.answers[key] = append(z.answers[key], rrs...)
+}
+
+func (z *testZones) addSigned(t *testing.T, zone string, rr dns.RR) {
+	z.add(rr, z.sign(t, zone, rr))
+}
+
+// deny sets the signed NSEC record answering the query of `name` and `qtype` with no data,
+// or all the queries without answers if `name` is empty.
+func (z *testZones) deny(t *testing.T, name string, qtype uint16, zone string, nsec dns.RR) {
+	z.denials[rrsetKey(name, qtype)] = []dns.RR{nsec, z.sign(t, zone, nsec)}
+}
+
+func (z *testZones) answer(q dns.Question) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetQuestion(q.Name, q.Qtype)
+	res.Response = true
+	if rrs, ok := z.answers[rrsetKey(q.Name, q.Qtype)]; ok {
+		res.Answer = append(res.Answer, rrs...)
+	} else if rrs, ok := z.denials[rrsetKey(q.Name, q.Qtype)]; ok {
+		res.Ns = append(res.Ns, rrs...)
+	} else {
+		res.Rcode = dns.RcodeNameError
+		res.Ns = append(res.Ns, z.denials[rrsetKey("", 0)]...)
+	}
+	return res
+}
+
+func (z *testZones) query(ctx context.Context, q dns.Question) (*dns.Msg, error) {
+	return z.answer(q), nil
+}
+
+// newValidator returns a validator trusting the root key of the zones.
+func (z *testZones) newValidator(t *testing.T) *dnssecValidator {
+	dir, err := ioutil.TempDir("", "test_dnssec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/root.key"
+	writeTempFile(t, filename, z.keys["."].String()+"\n")
+
+	v, err := newDNSSECValidator(filename, z.query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	z := newTestZones(t)
+	v := z.newValidator(t)
+
+	tampered := z.answer(dns.Question{Name: "www.test.", Qtype: dns.TypeA})
+	tampered.Answer[0] = newTestRR(t, "www.test. 3600 IN A 10.0.0.1")
+	stripped := z.answer(dns.Question{Name: "nx.test.", Qtype: dns.TypeA})
+	stripped.Ns = nil
+
+	tests := []struct {
+		name string
+		res  *dns.Msg
+		want dnssecResult
+	}{
+		{"signed", z.answer(dns.Question{Name: "www.test.", Qtype: dns.TypeA}), dnssecSecure},
+		{"unsigned delegation", z.answer(dns.Question{Name: "www.plain.test.", Qtype: dns.TypeA}), dnssecInsecure},
+		{"proven non-existent", z.answer(dns.Question{Name: "nx.test.", Qtype: dns.TypeA}), dnssecSecure},
+		{"tampered", tampered, dnssecBogus},
+		{"unsigned in signed zone", &dns.Msg{Answer: []dns.RR{newTestRR(t, "forged.test. 60 IN A 10.0.0.1")}}, dnssecBogus},
+		{"stripped denial", stripped, dnssecBogus},
+	}
+	for _, tt := range tests {
+		q := tt.res.Question
+		if len(q) == 0 {
+			q = []dns.Question{{Name: tt.res.Answer[0].Header().Name, Qtype: dns.TypeA}}
+		}
+		if got := v.validate(context.Background(), q[0], tt.res); got != tt.want {
+			t.Errorf("%s: expect %v, got %v", tt.name, tt.want, got)
+		}
+	}
+
+	// failing to fetch the keys tells nothing about the answer
+	v = z.newValidator(t)
+	v.query = func(ctx context.Context, q dns.Question) (*dns.Msg, error) {
+		return nil, context.DeadlineExceeded
+	}
+	for _, res := range []*dns.Msg{z.answer(dns.Question{Name: "www.test.", Qtype: dns.TypeA}), tampered} {
+		if got := v.validate(context.Background(), res.Question[0], res); got != dnssecIndeterminate {
+			t.Errorf("Expect %v if the keys cannot be fetched, got %v", dnssecIndeterminate, got)
+		}
+	}
+}
+
+func TestDNSSECRootTrustAnchors(t *testing.T) {
+	v, err := newDNSSECValidator("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.anchors["."]) != 2 {
+		t.Errorf("Expect 2 root trust anchors, got %v", v.anchors)
+	}
+}
+
+func TestCanonicalLess(t *testing.T) {
+	// the example in RFC 4034 section 6.1
+	names := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	for i := 0; i+1 < len(names); i++ {
+		if !canonicalLess(names[i], names[i+1]) || canonicalLess(names[i+1], names[i]) {
+			t.Errorf("%s should be before %s", names[i], names[i+1])
+		}
+	}
+}
+
+func Test_spoofing_proof_resolver_dnssec(t *testing.T) {
+	z := newTestZones(t)
+	forge := func(w dns.ResponseWriter, req *dns.Msg) {
+		res := z.answer(req.Question[0])
+		res.Id = req.Id
+		// 114.114.114.114 belongs to China, it would be trusted without DNSSEC
+		for i, rr := range res.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				res.Answer[i] = &dns.A{Hdr: a.Hdr, A: net.ParseIP("114.114.114.114")}
+			}
+		}
+		w.WriteMsg(res)
+	}
+	fast, stopFast := startTestDNSServer(t, "udp", forge)
+	defer stopFast()
+	clean, stopClean := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		if !req.IsEdns0().Do() {
+			t.Errorf("DO should be set on the queries")
+		}
+		res := z.answer(req.Question[0])
+		res.Id = req.Id
+		w.WriteMsg(res)
+	})
+	defer stopClean()
+
+	resolver := newSpoofingProofResolver(newStaticUpstreamProvider(fast), newStaticUpstreamProvider(clean), 1024)
+	resolver.validator = z.newValidator(t)
+	resolver.validator.query = resolver.queryClean
+
+	q := dns.Question{Name: "www.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp")
+	if upstream != clean || !res.AuthenticatedData || !strings.Contains(res.Answer[0].String(), "127.0.0.1") {
+		t.Errorf("Expect the authentic answer from %s, got %v from %s", clean, res, upstream)
+	}
+
+	// no clean answer can be trusted
+	resolver.cleanUpstreamProvider = newStaticUpstreamProvider(fast)
+	resolver.cnDomains = newCNDomainCache(1024, time.Hour)
+	if res, _ := resolver.resolve(context.Background(), q, true, false, nil, "udp"); res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expect SERVFAIL for bogus answers, got %v", res)
+	}
+}
+
+func Test_spoofing_proof_resolver_dnssec_indeterminate(t *testing.T) {
+	z := newTestZones(t)
+	upstream, stop := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		res := z.answer(req.Question[0])
+		res.Id = req.Id
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	provider := newStaticUpstreamProvider(upstream)
+	resolver := newSpoofingProofResolver(provider, provider, 1024)
+	resolver.validator = z.newValidator(t)
+	resolver.validator.query = func(ctx context.Context, q dns.Question) (*dns.Msg, error) {
+		return nil, context.DeadlineExceeded
+	}
+
+	q := dns.Question{Name: "www.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, _ := resolver.resolve(context.Background(), q, true, false, nil, "udp")
+	if res.Rcode != dns.RcodeSuccess || res.AuthenticatedData {
+		t.Errorf("Expect the answer without AD if the keys cannot be fetched, got %v", res)
+	}
+}
+
+func TestServerDNSSECFlags(t *testing.T) {
+	z := newTestZones(t)
+	upstream, stop := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		res := z.answer(req.Question[0])
+		if req.Question[0].Name == "forged.test." {
+			res.Rcode = dns.RcodeSuccess
+			res.Ns = nil
+			res.Answer = []dns.RR{newTestRR(t, "forged.test. 60 IN A 10.0.0.1")}
+		}
+		res.Id = req.Id
+		w.WriteMsg(res)
+	})
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "test_dnssec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTempFile(t, dir+"/root.key", z.keys["."].String()+"\n")
+
+	s, err := NewServer(Config{
+		FastUpstream:  upstream,
+		CleanUpstream: upstream,
+		Listen:        "127.0.0.1:0",
+		CacheCap:      16,
+		DNSSEC:        true,
+		TrustAnchor:   dir + "/root.key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	// the AD bit is only set for the clients asking for it by DO or AD
+	tests := []struct {
+		name     string
+		do       bool
+		ad       bool
+		expectAD bool
+	}{
+		{"neither", false, false, false},
+		{"AD", false, true, true},
+		{"DO", true, false, true},
+	}
+	for _, tt := range tests {
+		req := &dns.Msg{}
+		req.SetQuestion("www.test.", dns.TypeA)
+		req.AuthenticatedData = tt.ad
+		if tt.do {
+			req.SetEdns0(dns.DefaultMsgSize, true)
+		}
+		res, _ := s.lookup(context.Background(), req, "udp")
+		if res.Rcode != dns.RcodeSuccess || res.AuthenticatedData != tt.expectAD {
+			t.Errorf("%s: expect AD %v, got %v", tt.name, tt.expectAD, res)
+		}
+	}
+
+	// the client setting CD gets the answer not validated, which is not cached for the others
+	req := &dns.Msg{}
+	req.SetQuestion("forged.test.", dns.TypeA)
+	req.CheckingDisabled = true
+	if res, _ := s.lookup(context.Background(), req, "udp"); res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.AuthenticatedData {
+		t.Errorf("Expect the answer not validated for CD, got %v", res)
+	}
+	req.CheckingDisabled = false
+	if res, _ := s.lookup(context.Background(), req, "udp"); res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expect SERVFAIL for the bogus answer without CD, got %v", res)
+	}
+}
@@ -0,0 +1,119 @@
+package freedns
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMediaType = "application/dns-message"
+	dohTimeout   = 2 * time.Second
+	// Queries which would make the GET url longer than this are sent by POST.
+	dohMaxGetURLLen = 2048
+)
+
+// dohTransport speaks DNS-over-HTTPS as defined in RFC 8484.
+type dohTransport struct {
+	url    string
+	client *http.Client
+}
+
+// parseDoHURL validates the url of a DoH upstream. The host is an IP address, or a hostname
+// resolved by the bootstrap servers, never by the system resolver, see newBootstrapDialer.
+func parseDoHURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, Error("Invalid DoH url " + rawurl)
+	}
+	if net.ParseIP(u.Hostname()) == nil && !isHostname(u.Hostname()) {
+		return nil, Error("Invalid host in DoH url " + rawurl)
+	}
+	return u, nil
+}
+
+func newDoHTransport(rawurl string, d dialer) (*dohTransport, error) {
+	if _, err := parseDoHURL(rawurl); err != nil {
+		return nil, err
+	}
+	return &dohTransport{
+		url: rawurl,
+		// the requests are bounded by the deadline of the context instead of client timeouts
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       d.DialContext,
+				ForceAttemptHTTP2: true,
+			},
+		},
+	}, nil
+}
+
+func (t *dohTransport) close() {
+	t.client.CloseIdleConnections()
+}
+
+func (t *dohTransport) exchange(ctx context.Context, req *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	// RFC 8484 section 4.1: the id should be 0 to maximize HTTP cache friendliness
+	m := req.Copy()
+	m.Id = 0
+	buf, err := m.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var httpReq *http.Request
+	getURL := t.url
+	if strings.Contains(getURL, "?") {
+		getURL += "&dns="
+	} else {
+		getURL += "?dns="
+	}
+	getURL += base64.RawURLEncoding.EncodeToString(buf)
+	if len(getURL) <= dohMaxGetURLLen {
+		httpReq, err = http.NewRequest(http.MethodGet, getURL, nil)
+	} else {
+		httpReq, err = http.NewRequest(http.MethodPost, t.url, bytes.NewReader(buf))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := withDefaultTimeout(ctx, dohTimeout)
+	defer cancel()
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+	resp, err := t.client.Do(httpReq)
+	if err != nil {
+		return nil, 0, contextError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, Error("DoH upstream responded " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, contextError(ctx, err)
+	}
+	rtt := time.Since(start)
+
+	res := &dns.Msg{}
+	if err := res.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+	res.Id = req.Id
+	return res, rtt, nil
+}
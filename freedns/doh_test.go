@@ -0,0 +1,116 @@
+package freedns
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newDoHStandIn starts a local DoH server which answers every A query with 127.0.0.1,
+// and registers the transport for it in defaultTransports.
+// It returns the server and the methods of the received requests.
+func newDoHStandIn(t *testing.T, path string) (*httptest.Server, *[]string) {
+	return startDoHStandIn(t, path, func(req *dns.Msg) *dns.Msg {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+		return res
+	})
+}
+
+// startDoHStandIn starts a local DoH server which replies by `answer`, and registers
+// the transport for it in defaultTransports.
+// It returns the server and the methods of the received requests.
+func startDoHStandIn(t *testing.T, path string, answer func(req *dns.Msg) *dns.Msg) (*httptest.Server, *[]string) {
+	methods := &[]string{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*methods = append(*methods, r.Method)
+
+		var buf []byte
+		var err error
+		if r.Method == http.MethodGet {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(w, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			buf, err = ioutil.ReadAll(r.Body)
+		}
+		req := &dns.Msg{}
+		if err == nil {
+			err = req.Unpack(buf)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		out, _ := answer(req).Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(out)
+	}))
+
+	useDoHStandIn(defaultTransports, srv, srv.URL+path)
+	return srv, methods
+}
+
+// useDoHStandIn registers the transport trusting the certificate of `srv` for `upstream` in `ts`.
+func useDoHStandIn(ts *transportSet, srv *httptest.Server, upstream string) {
+	ts.mu.Lock()
+	ts.m[upstream] = &dohTransport{url: upstream, client: srv.Client()}
+	ts.mu.Unlock()
+}
+
+func TestDoHUpstreamProvider(t *testing.T) {
+	provider, err := newUpstreamProvider("https://1.1.1.1/dns-query", upstreamOptions{})
+	if err != nil {
+		t.Errorf("Cannot create DoH upstream provider: %s", err.Error())
+		return
+	}
+	if upstream := provider.GetUpstream(); upstream != "https://1.1.1.1/dns-query" {
+		t.Errorf("DoH upstream provider invalid result %s", upstream)
+	}
+
+	for _, name := range []string{"https://", "https://dns.google/dns-query"} {
+		if _, err := newUpstreamProvider(name, upstreamOptions{}); err == nil {
+			t.Errorf("Should not create provider for %s", name)
+		}
+	}
+}
+
+func TestDoHResolve(t *testing.T) {
+	tests := []struct {
+		path   string
+		method string
+	}{
+		{"/dns-query", http.MethodGet},
+		// too long to be sent by GET
+		{"/" + strings.Repeat("a", dohMaxGetURLLen), http.MethodPost},
+	}
+	for _, tt := range tests {
+		srv, methods := newDoHStandIn(t, tt.path)
+
+		q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		res, _, err := naiveResolve(context.Background(), q, true, "udp", srv.URL+tt.path)
+		if err != nil {
+			t.Errorf("DoH resolve failed: %s", err.Error())
+		} else if len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Errorf("DoH resolve got wrong answer %v", res)
+		}
+		if len(*methods) != 1 || (*methods)[0] != tt.method {
+			t.Errorf("Expect one %s request, got %v", tt.method, *methods)
+		}
+		srv.Close()
+	}
+}
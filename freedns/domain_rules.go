@@ -0,0 +1,302 @@
+package freedns
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+)
+
+// route tells which upstream a domain is pinned to.
+type route int
+
+const (
+	routeNone route = iota
+	routeFast
+	routeClean
+)
+
+func (r route) String() string {
+	switch r {
+	case routeFast:
+		return "fast"
+	case routeClean:
+		return "clean"
+	}
+	return "none"
+}
+
+// suffixTrie maps domains to routes. A domain matches itself and all its subdomains,
+// and the longest matching domain wins.
+type suffixTrie struct {
+	children map[string]*suffixTrie
+	route    route
+}
+
+func newSuffixTrie() *suffixTrie {
+	return &suffixTrie{}
+}
+
+// insert adds `domain` with `r`. If the domain is already there,
+// routeClean wins as it is always safe to use the clean upstream.
+func (t *suffixTrie) insert(domain string, r route) {
+	node := t
+	labels := dns.SplitDomainName(domain)
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*suffixTrie)
+		}
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &suffixTrie{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if node.route != routeClean {
+		node.route = r
+	}
+}
+
+// match returns the route of the longest domain which `name` equals or is a subdomain of.
+func (t *suffixTrie) match(name string) route {
+	matched := t.route
+	node := t
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+		node = child
+		if node.route != routeNone {
+			matched = node.route
+		}
+	}
+	return matched
+}
+
+// parseDomainList reads domains from a file, one per line. Lines can be either
+// plain domains (optionally prefixed by "." or "*.") or dnsmasq rules like
+// server=/example.cn/114.114.114.114, of which only the domains are used.
+// Empty lines and comments starting with "#" are ignored.
+func parseDomainList(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	domains := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		var names []string
+		if strings.HasPrefix(line, "server=/") {
+			// server=/domain1/domain2/.../upstream
+			parts := strings.Split(strings.TrimPrefix(line, "server=/"), "/")
+			names = parts[:len(parts)-1]
+		} else {
+			names = []string{strings.TrimPrefix(strings.TrimPrefix(line, "*."), ".")}
+		}
+		for _, name := range names {
+			if _, ok := dns.IsDomainName(name); !ok || name == "" || strings.ContainsAny(name, " \t=") {
+				return nil, Error("Invalid domain at " + filename + ":" + strconv.Itoa(lineno) + ": " + line)
+			}
+			domains = append(domains, strings.ToLower(dns.Fqdn(name)))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// reloadDelay is how long to wait after the last change of the files before reloading them.
+const reloadDelay = 50 * time.Millisecond
+
+// domainRules pins the domains in the fast and the clean lists to the corresponding upstream,
+// and the domains matched by the gfwlists to the clean upstream. The fast and the clean lists
+// take precedence over the gfwlists. The lists are reloaded when the files change, and the last
+// valid lists are kept if the files become invalid.
+type domainRules struct {
+	fastFiles    []string
+	cleanFiles   []string
+	gfwlistFiles []string
+
+	mu      sync.RWMutex
+	trie    *suffixTrie
+	gfwlist *gfwList
+
+	// closing `done` stops watching the files, `stopped` is closed once the watcher exits
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// newDomainRules loads the lists from comma separated file names, and watches them.
+func newDomainRules(fastFiles string, cleanFiles string, gfwlistFiles string) (*domainRules, error) {
+	rules := &domainRules{
+		fastFiles:    splitFileList(fastFiles),
+		cleanFiles:   splitFileList(cleanFiles),
+		gfwlistFiles: splitFileList(gfwlistFiles),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	if err := rules.load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	files := append(append(append([]string{}, rules.fastFiles...), rules.cleanFiles...), rules.gfwlistFiles...)
+	for _, filename := range files {
+		if err := watcher.Add(filename); err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+	go func() {
+		defer close(rules.stopped)
+		defer watcher.Close()
+		logger := log.WithField("op", "domain_rules")
+		logger.Info("Start watching")
+		for {
+			select {
+			case <-rules.done:
+				logger.Info("Stop watching")
+				return
+			case _, ok := <-watcher.Events:
+				if !ok {
+					logger.Warn("Watch failed")
+					return
+				}
+			case err, ok := <-watcher.Errors:
+				logger.WithField("error", err).WithField("ok", ok).Warn("Watch failed")
+				return
+			}
+
+			// a file is usually truncated before being written, wait until the writes settle,
+			// otherwise the lists may be reloaded while they are empty
+			settle := time.NewTimer(reloadDelay)
+			for settled := false; !settled; {
+				select {
+				case <-rules.done:
+					settle.Stop()
+					logger.Info("Stop watching")
+					return
+				case _, ok := <-watcher.Events:
+					if !ok {
+						logger.Warn("Watch failed")
+						return
+					}
+					// drain the fire already queued, or the loop ends right after the Reset
+					if !settle.Stop() {
+						<-settle.C
+					}
+					settle.Reset(reloadDelay)
+				case <-settle.C:
+					settled = true
+				}
+			}
+			logger.Info("Reload domain lists")
+
+			if err := rules.load(); err != nil {
+				logger.WithField("error", err).Warn("Cannot read domain lists, ignore")
+			}
+		}
+	}()
+
+	return rules, nil
+}
+
+func splitFileList(files string) []string {
+	list := make([]string, 0)
+	for _, f := range strings.Split(files, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// load reads all the lists into a new trie, and replaces the current one if succeeded.
+func (rules *domainRules) load() error {
+	trie := newSuffixTrie()
+	count := 0
+	for _, list := range []struct {
+		files []string
+		route route
+	}{
+		{rules.fastFiles, routeFast},
+		{rules.cleanFiles, routeClean},
+	} {
+		for _, filename := range list.files {
+			domains, err := parseDomainList(filename)
+			if err != nil {
+				return err
+			}
+			for _, domain := range domains {
+				trie.insert(domain, list.route)
+			}
+			count += len(domains)
+		}
+	}
+
+	gfwlist := newGFWList()
+	for _, filename := range rules.gfwlistFiles {
+		if err := gfwlist.load(filename); err != nil {
+			return err
+		}
+	}
+
+	rules.mu.Lock()
+	rules.trie = trie
+	rules.gfwlist = gfwlist
+	rules.mu.Unlock()
+	log.WithField("op", "domain_rules").WithField("count", count).Info("Domain lists loaded")
+	return nil
+}
+
+// match returns which upstream `name` is pinned to. It is safe to call on nil rules.
+func (rules *domainRules) match(name string) route {
+	if rules == nil {
+		return routeNone
+	}
+	rules.mu.RLock()
+	defer rules.mu.RUnlock()
+	if r := rules.trie.match(name); r != routeNone {
+		return r
+	}
+	if rules.gfwlist.match(name) {
+		return routeClean
+	}
+	return routeNone
+}
+
+// Close stops watching the files. It is safe to call on nil rules.
+func (rules *domainRules) Close() error {
+	if rules == nil {
+		return nil
+	}
+	rules.closeOnce.Do(func() {
+		close(rules.done)
+	})
+	<-rules.stopped
+	return nil
+}
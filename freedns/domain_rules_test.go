@@ -0,0 +1,124 @@
+package freedns
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSuffixTrie(t *testing.T) {
+	trie := newSuffixTrie()
+	trie.insert("cn.", routeFast)
+	trie.insert("google.cn.", routeClean)
+	trie.insert("example.com.", routeFast)
+	trie.insert("example.com.", routeClean)
+
+	tests := []struct {
+		name     string
+		expected route
+	}{
+		{"cn.", routeFast},
+		{"www.ustc.edu.cn.", routeFast},
+		{"google.cn.", routeClean},
+		{"Mail.Google.CN.", routeClean},
+		{"oogle.cn.", routeFast},
+		{"com.", routeNone},
+		{"www.example.com.", routeClean},
+		{"example.org.", routeNone},
+	}
+	for _, tt := range tests {
+		if r := trie.match(tt.name); r != tt.expected {
+			t.Errorf("%s should match %s, got %s", tt.name, tt.expected, r)
+		}
+	}
+}
+
+func writeTempFile(t *testing.T, filename string, content string) {
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseDomainList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/list.conf"
+
+	writeTempFile(t, filename, `# comment
+server=/baidu.com/114.114.114.114
+server=/qq.com/WeChat.com/114.114.114.114 # comment
+
+.example.cn
+*.example.org
+example.net.
+`)
+	domains, err := parseDomainList(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"baidu.com.", "qq.com.", "wechat.com.", "example.cn.", "example.org.", "example.net."}
+	if len(domains) != len(expected) {
+		t.Fatalf("Expect %v, got %v", expected, domains)
+	}
+	for i := range domains {
+		if domains[i] != expected[i] {
+			t.Errorf("Expect %s, got %s", expected[i], domains[i])
+		}
+	}
+
+	for _, content := range []string{"hello world\n", "address=/example.com/1.2.3.4\n", "server=//114.114.114.114\n"} {
+		writeTempFile(t, filename, content)
+		if _, err := parseDomainList(filename); err == nil {
+			t.Errorf("Should not parse %q", content)
+		}
+	}
+}
+
+func TestDomainRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_domains")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fast, clean := dir+"/fast.conf", dir+"/clean.conf"
+	writeTempFile(t, fast, "server=/cn/114.114.114.114\n")
+	writeTempFile(t, clean, "google.cn\n")
+
+	if _, err := newDomainRules(fast, dir+"/not_exist.conf", ""); err == nil {
+		t.Errorf("Should not create rules for missing files")
+	}
+
+	rules, err := newDomainRules(fast, clean, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rules.Close()
+	if r := rules.match("www.google.cn."); r != routeClean {
+		t.Errorf("Bad result %s", r)
+	}
+
+	writeTempFile(t, clean, "google.cn\ngov.cn\n")
+	time.Sleep(100 * time.Millisecond)
+	// should be updated
+	if r := rules.match("www.gov.cn."); r != routeClean {
+		t.Errorf("Bad result %s", r)
+	}
+
+	writeTempFile(t, fast, "some invalid content\n")
+	time.Sleep(100 * time.Millisecond)
+	// should not be updated
+	if r := rules.match("www.ustc.edu.cn."); r != routeFast {
+		t.Errorf("Bad result %s", r)
+	}
+
+	// nil rules match nothing
+	var none *domainRules
+	if r := none.match("www.ustc.edu.cn."); r != routeNone {
+		t.Errorf("Bad result %s", r)
+	}
+	none.Close()
+}
@@ -0,0 +1,225 @@
+package freedns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	doqTimeout = 2 * time.Second
+	// The connection is closed if nothing is received for this long, and dialed again on the next query.
+	doqIdleTimeout = 30 * time.Second
+
+	// the error codes of RFC 9250 section 4.3
+	doqNoError          = 0x0
+	doqRequestCancelled = 0x3
+)
+
+// doqALPN is the ALPN token of DNS-over-QUIC.
+var doqALPN = []string{"doq"}
+
+// doqTransport speaks DNS-over-QUIC as defined in RFC 9250. All the queries are multiplexed
+// over one long-lived connection, one stream per query. When the connection has to be dialed
+// again, the TLS session is resumed and the first query is sent in 0-RTT data.
+type doqTransport struct {
+	addr       string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	dialer     dialer
+
+	mu     sync.Mutex
+	conn   *doqConn
+	closed bool
+}
+
+// doqConn is a QUIC connection with the UDP socket it runs on.
+type doqConn struct {
+	quic.EarlyConnection
+	tr *quic.Transport
+	pc net.PacketConn
+}
+
+func (c *doqConn) close() {
+	c.CloseWithError(doqNoError, "")
+	c.tr.Close()
+	c.pc.Close()
+}
+
+// parseDoQURL parses urls like quic://94.140.14.140:853?name=dns.adguard-dns.com&pin=base64(sha256(spki))
+// and returns the address to dial and the tls configuration, see parseDoTURL.
+func parseDoQURL(rawurl string) (string, *tls.Config, error) {
+	addr, cfg, err := parseTLSUpstreamURL(rawurl, "quic", "DoQ")
+	if err != nil {
+		return "", nil, err
+	}
+	cfg.NextProtos = doqALPN
+	cfg.MinVersion = tls.VersionTLS13
+	return addr, cfg, nil
+}
+
+func newDoQTransport(rawurl string, d dialer) (*doqTransport, error) {
+	addr, cfg, err := parseDoQURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &doqTransport{
+		addr:       addr,
+		tlsConfig:  cfg,
+		quicConfig: &quic.Config{MaxIdleTimeout: doqIdleTimeout},
+		dialer:     d,
+	}, nil
+}
+
+func (t *doqTransport) exchange(ctx context.Context, req *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	for {
+		conn, reused, err := t.getConn(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		start := time.Now()
+		res, err := exchangeStream(ctx, conn, req)
+		if err != nil {
+			if conn.Context().Err() != nil {
+				t.dropConn(conn)
+				if reused && ctx.Err() == nil {
+					// the connection is gone, e.g. closed by the server when idle, dial again
+					continue
+				}
+			}
+			return nil, 0, err
+		}
+		return res, time.Since(start), nil
+	}
+}
+
+// exchangeStream sends `req` on a new stream of `conn` and reads the reply.
+func exchangeStream(ctx context.Context, conn *doqConn, req *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	stop := interruptOnDone(ctx, stream, doqTimeout)
+	defer stop()
+
+	res, err := exchangeOnStream(stream, req)
+	if err != nil {
+		stream.CancelRead(doqRequestCancelled)
+		stream.CancelWrite(doqRequestCancelled)
+		return nil, contextError(ctx, err)
+	}
+	return res, nil
+}
+
+func exchangeOnStream(stream quic.Stream, req *dns.Msg) (*dns.Msg, error) {
+	// the message ID must be 0 over QUIC (RFC 9250 section 4.2.1), as the stream tells the replies apart
+	msg := req.Copy()
+	msg.Id = 0
+	buf, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// the messages are prefixed by their length like over TCP, and the end of the stream ends the query
+	out := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+	if _, err := stream.Write(out); err != nil {
+		return nil, err
+	}
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(stream, length[:]); err != nil {
+		return nil, err
+	}
+	buf = make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return nil, err
+	}
+	res := &dns.Msg{}
+	if err := res.Unpack(buf); err != nil {
+		return nil, err
+	}
+	res.Id = req.Id
+	return res, nil
+}
+
+// getConn returns the connection to the server, and dials it if there is none or it is closed.
+func (t *doqTransport) getConn(ctx context.Context) (*doqConn, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, false, errTransportsClosed
+	}
+	if t.conn != nil {
+		if t.conn.Context().Err() == nil {
+			return t.conn, true, nil
+		}
+		t.conn.close()
+		t.conn = nil
+	}
+
+	ctx, cancel := withDefaultTimeout(ctx, doqTimeout)
+	defer cancel()
+	udpConn, err := t.dialer.DialContext(ctx, "udp", t.addr)
+	if err != nil {
+		return nil, false, err
+	}
+	pc := connectedPacketConn{udpConn}
+	tr := &quic.Transport{Conn: pc}
+	// DialEarly sends the first query in 0-RTT data if the session is resumed
+	conn, err := tr.DialEarly(ctx, udpConn.RemoteAddr(), t.tlsConfig, t.quicConfig)
+	if err != nil {
+		tr.Close()
+		pc.Close()
+		return nil, false, contextError(ctx, err)
+	}
+	t.conn = &doqConn{EarlyConnection: conn, tr: tr, pc: pc}
+	return t.conn, false, nil
+}
+
+// dropConn closes `conn` if it is still the connection of the transport.
+func (t *doqTransport) dropConn(conn *doqConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == conn {
+		t.conn.close()
+		t.conn = nil
+	}
+}
+
+func (t *doqTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.conn != nil {
+		t.conn.close()
+		t.conn = nil
+	}
+}
+
+// connectedPacketConn turns a connected UDP connection, which may come from the bootstrap
+// dialer, into the packet connection QUIC runs on. The packets only go to the connected address.
+type connectedPacketConn struct {
+	net.Conn
+}
+
+func (c connectedPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.Read(b)
+	return n, c.RemoteAddr(), err
+}
+
+func (c connectedPacketConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return c.Write(b)
+}
@@ -0,0 +1,180 @@
+package freedns
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqStandIn is a local DoQ server answering every A query with 127.0.0.1.
+type doqStandIn struct {
+	l    *quic.EarlyListener
+	cert tls.Certificate
+	// the accepted connections and the ones resumed by 0-RTT
+	accepted int32
+	resumed  int32
+	// the message IDs of the received queries, which must be 0
+	badIDs int32
+}
+
+func newDoQStandIn(t *testing.T) *doqStandIn {
+	s := &doqStandIn{cert: newTestCertificate(t)}
+	l, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{s.cert},
+		NextProtos:   doqALPN,
+	}, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.l = l
+	go func() {
+		for {
+			conn, err := l.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepted, 1)
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *doqStandIn) serve(conn quic.EarlyConnection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		if conn.ConnectionState().Used0RTT {
+			atomic.AddInt32(&s.resumed, 1)
+		}
+		go func() {
+			defer stream.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(stream, length[:]); err != nil {
+				return
+			}
+			buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(stream, buf); err != nil {
+				return
+			}
+			req := &dns.Msg{}
+			if err := req.Unpack(buf); err != nil {
+				return
+			}
+			if req.Id != 0 {
+				atomic.AddInt32(&s.badIDs, 1)
+			}
+			w := &doqResponseWriter{stream: stream}
+			answerLocalhost(w, req)
+		}()
+	}
+}
+
+func (s *doqStandIn) upstream() string {
+	return "quic://" + s.l.Addr().String()
+}
+
+// doqResponseWriter writes the length prefixed replies to a stream.
+type doqResponseWriter struct {
+	dns.ResponseWriter
+	stream quic.Stream
+}
+
+func (w *doqResponseWriter) WriteMsg(res *dns.Msg) error {
+	buf, err := res.Pack()
+	if err != nil {
+		return err
+	}
+	out := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(out, uint16(len(buf)))
+	copy(out[2:], buf)
+	_, err = w.stream.Write(out)
+	return err
+}
+
+// newTrustingDoQTransport creates the transport for `upstream` trusting `cert`.
+func newTrustingDoQTransport(t *testing.T, upstream string, cert tls.Certificate) *doqTransport {
+	tr, err := newDoQTransport(upstream, defaultTransports.dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.tlsConfig.RootCAs = x509.NewCertPool()
+	tr.tlsConfig.RootCAs.AddCert(cert.Leaf)
+	return tr
+}
+
+func TestDoQUpstreamProvider(t *testing.T) {
+	provider, err := newUpstreamProvider("quic://94.140.14.140?name=dns.adguard-dns.com", upstreamOptions{})
+	if err != nil {
+		t.Fatalf("Cannot create DoQ upstream provider: %s", err.Error())
+	}
+	if upstream := provider.GetUpstream(); upstream != "quic://94.140.14.140?name=dns.adguard-dns.com" {
+		t.Errorf("DoQ upstream provider invalid result %s", upstream)
+	}
+
+	addr, cfg, err := parseDoQURL("quic://94.140.14.140?name=dns.adguard-dns.com")
+	if err != nil || addr != "94.140.14.140:853" || cfg.ServerName != "dns.adguard-dns.com" || cfg.NextProtos[0] != "doq" {
+		t.Errorf("Bad DoQ url parsing: %s %v %v", addr, cfg, err)
+	}
+	for _, name := range []string{"quic://", "quic://dns.adguard-dns.com", "quic://1.1.1.1?pin=abc"} {
+		if _, err := newUpstreamProvider(name, upstreamOptions{}); err == nil {
+			t.Errorf("Should not create provider for %s", name)
+		}
+	}
+}
+
+func TestDoQResolve(t *testing.T) {
+	s := newDoQStandIn(t)
+	defer s.l.Close()
+
+	tr := newTrustingDoQTransport(t, s.upstream(), s.cert)
+	defer tr.close()
+
+	// the queries are multiplexed over one connection
+	for i := 0; i < 3; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("example.com.", dns.TypeA)
+		res, _, err := tr.exchange(context.Background(), req, "udp")
+		if err != nil {
+			t.Fatalf("DoQ exchange failed: %s", err.Error())
+		}
+		if res.Id != req.Id || len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Errorf("DoQ exchange got wrong answer %v", res)
+		}
+	}
+	if accepted := atomic.LoadInt32(&s.accepted); accepted != 1 {
+		t.Errorf("Expect 1 connection, got %d", accepted)
+	}
+	if badIDs := atomic.LoadInt32(&s.badIDs); badIDs != 0 {
+		t.Errorf("Expect message ID 0 over QUIC, got %d bad ones", badIDs)
+	}
+
+	// the connection is dialed again after it is closed, resuming the session by 0-RTT
+	tr.dropConn(tr.conn)
+	req := &dns.Msg{}
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := tr.exchange(context.Background(), req, "udp"); err != nil {
+		t.Fatalf("DoQ exchange failed after reconnecting: %s", err.Error())
+	}
+	if accepted := atomic.LoadInt32(&s.accepted); accepted != 2 {
+		t.Errorf("Expect 2 connections, got %d", accepted)
+	}
+	if resumed := atomic.LoadInt32(&s.resumed); resumed != 1 {
+		t.Errorf("Expect the query sent by 0-RTT, got %d", resumed)
+	}
+
+	// the errors are reported to the resolver
+	tr.close()
+	if _, _, err := tr.exchange(context.Background(), req, "udp"); err != errTransportsClosed {
+		t.Errorf("Expect %v after close, got %v", errTransportsClosed, err)
+	}
+}
@@ -0,0 +1,200 @@
+package freedns
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dotDefaultPort = "853"
+	dotTimeout     = 2 * time.Second
+	// Idle connections are dropped after this, servers usually close them around this time.
+	dotIdleTimeout  = 10 * time.Second
+	dotMaxIdleConns = 4
+)
+
+// dotTransport speaks DNS-over-TLS as defined in RFC 7858.
+// Connections are kept open and reused by the following queries.
+type dotTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+	dialer    dialer
+
+	mu     sync.Mutex
+	idle   []idleConn
+	closed bool
+}
+
+type idleConn struct {
+	conn  *dns.Conn
+	since time.Time
+}
+
+// parseDoTURL parses urls like tls://1.1.1.1:853?name=cloudflare-dns.com&pin=base64(sha256(spki))
+// and returns the address to dial and the tls configuration.
+//
+// The certificate is verified against `name`, which defaults to the host of the url.
+// If `pin` is given (may be repeated), one of the certificates of the server
+// must have a matching public key as well.
+func parseDoTURL(rawurl string) (string, *tls.Config, error) {
+	return parseTLSUpstreamURL(rawurl, "tls", "DoT")
+}
+
+// parseTLSUpstreamURL parses the url of an upstream secured by TLS, like DoT and DoQ,
+// given as `scheme`://host[:port][?name=servername&pin=spki]. The port defaults to 853.
+// `kind` names the protocol in the errors.
+func parseTLSUpstreamURL(rawurl string, scheme string, kind string) (string, *tls.Config, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme != scheme || u.Host == "" {
+		return "", nil, Error("Invalid " + kind + " url " + rawurl)
+	}
+	host, port := u.Hostname(), u.Port()
+	if net.ParseIP(host) == nil && !isHostname(host) {
+		return "", nil, Error("Invalid host in " + kind + " url " + rawurl)
+	}
+	if port == "" {
+		port = dotDefaultPort
+	}
+
+	query := u.Query()
+	serverName := query.Get("name")
+	if serverName == "" {
+		serverName = host
+	}
+
+	pins := make([][]byte, 0)
+	for _, p := range query["pin"] {
+		pin, err := base64.StdEncoding.DecodeString(p)
+		if err != nil || len(pin) != sha256.Size {
+			return "", nil, Error("Invalid SPKI pin " + p)
+		}
+		pins = append(pins, pin)
+	}
+
+	cfg := &tls.Config{
+		ServerName: serverName,
+		// Resume sessions to save round trips when a connection has to be reopened.
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+	if len(pins) > 0 {
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifySPKIPins(rawCerts, pins)
+		}
+	}
+	return net.JoinHostPort(host, port), cfg, nil
+}
+
+// verifySPKIPins checks if any of the certificates matches any of the pins.
+func verifySPKIPins(rawCerts [][]byte, pins [][]byte) error {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if subtle.ConstantTimeCompare(sum[:], pin) == 1 {
+				return nil
+			}
+		}
+	}
+	return Error("No certificate matches the SPKI pins")
+}
+
+func newDoTTransport(rawurl string, d dialer) (*dotTransport, error) {
+	addr, cfg, err := parseDoTURL(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return &dotTransport{
+		addr:      addr,
+		tlsConfig: cfg,
+		dialer:    d,
+	}, nil
+}
+
+func (t *dotTransport) exchange(ctx context.Context, req *dns.Msg, _ string) (*dns.Msg, time.Duration, error) {
+	for {
+		conn, reused, err := t.getConn(ctx)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		start := time.Now()
+		res, err := exchangeConn(ctx, conn, req, dotTimeout)
+		if err != nil {
+			conn.Close()
+			if reused && ctx.Err() == nil {
+				// the server may have closed the idle connection, try the next one
+				continue
+			}
+			return nil, 0, err
+		}
+		rtt := time.Since(start)
+
+		t.putConn(conn)
+		return res, rtt, nil
+	}
+}
+
+// getConn returns an idle connection, or dials a new one if there is none.
+func (t *dotTransport) getConn(ctx context.Context) (*dns.Conn, bool, error) {
+	t.mu.Lock()
+	for len(t.idle) > 0 {
+		ic := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		if time.Since(ic.since) < dotIdleTimeout {
+			t.mu.Unlock()
+			return ic.conn, true, nil
+		}
+		ic.conn.Close()
+	}
+	t.mu.Unlock()
+
+	conn, _, err := dialFallback(ctx, t.dialer, "tcp", t.addr, dotTimeout)
+	if err != nil {
+		return nil, false, err
+	}
+	tlsConn := tls.Client(conn, t.tlsConfig)
+	stop := interruptOnDone(ctx, tlsConn, dotTimeout)
+	err = tlsConn.Handshake()
+	stop()
+	if err != nil {
+		tlsConn.Close()
+		return nil, false, contextError(ctx, err)
+	}
+	return &dns.Conn{Conn: tlsConn}, false, nil
+}
+
+// putConn keeps the connection for reuse.
+func (t *dotTransport) putConn(conn *dns.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || len(t.idle) >= dotMaxIdleConns {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, idleConn{conn, time.Now()})
+}
+
+// close closes the idle connections, the connections in use are closed
+// when they are put back.
+func (t *dotTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for _, ic := range t.idle {
+		ic.conn.Close()
+	}
+	t.idle = nil
+}
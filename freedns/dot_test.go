@@ -0,0 +1,160 @@
+package freedns
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// countingListener counts the accepted connections.
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "freedns test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// answerLocalhost answers every query with 127.0.0.1.
+func answerLocalhost(w dns.ResponseWriter, req *dns.Msg) {
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(127, 0, 0, 1),
+	})
+	w.WriteMsg(res)
+}
+
+// newDoTStandIn starts a local DoT server and returns the listener and the certificate.
+func newDoTStandIn(t *testing.T) (*dns.Server, *countingListener, tls.Certificate) {
+	cert := newTestCertificate(t)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &countingListener{Listener: l}
+	srv := &dns.Server{Listener: cl, Net: "tcp-tls", Handler: dns.HandlerFunc(answerLocalhost)}
+	go srv.ActivateAndServe()
+	return srv, cl, cert
+}
+
+// registerDoTTransport creates the transport for `upstream` trusting `cert`.
+func registerDoTTransport(t *testing.T, upstream string, cert tls.Certificate) {
+	tr, err := newDoTTransport(upstream, defaultTransports.dialer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.tlsConfig.RootCAs = x509.NewCertPool()
+	tr.tlsConfig.RootCAs.AddCert(cert.Leaf)
+
+	defaultTransports.mu.Lock()
+	defaultTransports.m[upstream] = tr
+	defaultTransports.mu.Unlock()
+}
+
+func TestDoTUpstreamProvider(t *testing.T) {
+	provider, err := newUpstreamProvider("tls://1.1.1.1?name=cloudflare-dns.com", upstreamOptions{})
+	if err != nil {
+		t.Errorf("Cannot create DoT upstream provider: %s", err.Error())
+		return
+	}
+	if upstream := provider.GetUpstream(); upstream != "tls://1.1.1.1?name=cloudflare-dns.com" {
+		t.Errorf("DoT upstream provider invalid result %s", upstream)
+	}
+
+	addr, cfg, err := parseDoTURL("tls://1.1.1.1?name=cloudflare-dns.com")
+	if err != nil || addr != "1.1.1.1:853" || cfg.ServerName != "cloudflare-dns.com" {
+		t.Errorf("Bad parse result %s %v %v", addr, cfg, err)
+	}
+
+	for _, name := range []string{"tls://", "tls://dns.google", "tls://1.1.1.1?pin=abc"} {
+		if _, err := newUpstreamProvider(name, upstreamOptions{}); err == nil {
+			t.Errorf("Should not create provider for %s", name)
+		}
+	}
+}
+
+func TestDoTResolve(t *testing.T) {
+	srv, l, cert := newDoTStandIn(t)
+	defer srv.Shutdown()
+
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	goodPin := url.QueryEscape(base64.StdEncoding.EncodeToString(sum[:]))
+	badPin := url.QueryEscape(base64.StdEncoding.EncodeToString(make([]byte, sha256.Size)))
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	upstream := "tls://" + l.Addr().String() + "?pin=" + goodPin
+	registerDoTTransport(t, upstream, cert)
+	for i := 0; i < 3; i++ {
+		res, _, err := naiveResolve(context.Background(), q, true, "udp", upstream)
+		if err != nil {
+			t.Errorf("DoT resolve failed: %s", err.Error())
+		} else if len(res.Answer) != 1 || res.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+			t.Errorf("DoT resolve got wrong answer %v", res)
+		}
+	}
+	if accepted := atomic.LoadInt32(&l.accepted); accepted != 1 {
+		t.Errorf("Expect the connection to be reused, got %d connections", accepted)
+	}
+
+	upstream = "tls://" + l.Addr().String() + "?pin=" + badPin
+	registerDoTTransport(t, upstream, cert)
+	if _, _, err := naiveResolve(context.Background(), q, true, "udp", upstream); err == nil {
+		t.Errorf("DoT resolve should fail with mismatched pin")
+	}
+
+	upstream = "tls://" + l.Addr().String() + "?name=wrong.example"
+	registerDoTTransport(t, upstream, cert)
+	if _, _, err := naiveResolve(context.Background(), q, true, "udp", upstream); err == nil {
+		t.Errorf("DoT resolve should fail with mismatched server name")
+	}
+}
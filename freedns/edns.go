@@ -0,0 +1,175 @@
+package freedns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP buffer size advertised to the upstreams and the clients,
+// which avoids IP fragmentation on most networks. Larger answers are sent over TCP.
+const ednsUDPSize = 1232
+
+// parseECS parses an EDNS Client Subnet given as ip/prefix, or a bare IP which
+// stands for its /24 (IPv4) or /56 (IPv6). 0.0.0.0/0 asks the upstream not to
+// use the address of the client at all.
+func parseECS(s string) (*dns.EDNS0_SUBNET, error) {
+	if s == "" {
+		return nil, nil
+	}
+	addr, prefix := s, ""
+	if i := strings.Index(s, "/"); i >= 0 {
+		addr, prefix = s[:i], s[i+1:]
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, Error("Invalid client subnet " + s)
+	}
+
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+		ecs.Family, ecs.SourceNetmask = 1, 24
+	} else {
+		ecs.Family, ecs.SourceNetmask = 2, 56
+	}
+	if prefix != "" {
+		n, err := strconv.Atoi(prefix)
+		if err != nil || n < 0 || n > bits {
+			return nil, Error("Invalid client subnet " + s)
+		}
+		ecs.SourceNetmask = uint8(n)
+	}
+	ecs.Address = ip.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))
+	return ecs, nil
+}
+
+// findECS returns the client subnet option of `opt`, or nil if there is none.
+func findECS(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// upstreamOPT returns the OPT record to send to an upstream, or nil if there should be none.
+// The DO bit and the end-to-end options of the client are forwarded, while the options
+// only meaningful between the client and us (cookie, keepalive, padding) are dropped.
+// `ecs`, if any, replaces the client subnet given by the client, which is dropped if `hideECS`.
+func upstreamOPT(client *dns.OPT, ecs *dns.EDNS0_SUBNET, hideECS bool) *dns.OPT {
+	if client == nil && ecs == nil {
+		return nil
+	}
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(ednsUDPSize)
+	if client != nil {
+		opt.SetDo(client.Do())
+		for _, o := range client.Option {
+			switch o.Option() {
+			case dns.EDNS0COOKIE, dns.EDNS0TCPKEEPALIVE, dns.EDNS0PADDING:
+				continue
+			case dns.EDNS0SUBNET:
+				if ecs != nil || hideECS {
+					continue
+				}
+			}
+			opt.Option = append(opt.Option, o)
+		}
+	}
+	if ecs != nil {
+		opt.Option = append(opt.Option, ecs)
+	}
+	return opt
+}
+
+// withDO returns a copy of `opt` with the DO bit set, or a new OPT record if it is nil.
+func withDO(opt *dns.OPT) *dns.OPT {
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(ednsUDPSize)
+	} else {
+		opt = dns.Copy(opt).(*dns.OPT)
+	}
+	opt.SetDo()
+	return opt
+}
+
+// replyOPT replaces the OPT record from the upstream in `res` by ours for the client,
+// or removes it if the client does not speak EDNS. The client subnet of the client
+// is echoed with the scope given by the upstream, see ecsScope.
+func replyOPT(res *dns.Msg, client *dns.OPT) {
+	scope := ecsScope(res, client)
+	extra := res.Extra[:0]
+	for _, rr := range res.Extra {
+		if _, ok := rr.(*dns.OPT); ok {
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	res.Extra = extra
+	if client == nil {
+		return
+	}
+
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(ednsUDPSize)
+	opt.SetDo(client.Do())
+	if ecs := findECS(client); ecs != nil {
+		echo := *ecs
+		echo.SourceScope = scope
+		opt.Option = append(opt.Option, &echo)
+	}
+	res.Extra = append(res.Extra, opt)
+}
+
+// ecsToString returns the client subnet of `opt` masked by the source prefix.
+func ecsToString(opt *dns.OPT) string {
+	ecs := findECS(opt)
+	if ecs == nil {
+		return ""
+	}
+	return subnetToString(ecs, ecs.SourceNetmask)
+}
+
+// subnetToString returns the address of `ecs` masked by `prefix` bits, so the clients
+// in the same subnet of `prefix` share the string.
+func subnetToString(ecs *dns.EDNS0_SUBNET, prefix uint8) string {
+	bits := 128
+	if ecs.Family == 1 {
+		bits = 32
+	}
+	ip := ecs.Address.Mask(net.CIDRMask(int(prefix), bits))
+	if ip == nil {
+		// the family does not match the address
+		ip = ecs.Address
+	}
+	return ip.String() + "/" + strconv.Itoa(int(prefix))
+}
+
+// ecsScope returns the scope prefix of `res`, the answer to the query with the client subnet
+// of `opt`, or 0 if the answer is the same for all the clients: the upstream gives no scope,
+// or the subnet of the client is not sent to it. The scope is no longer than the source prefix,
+// as RFC 7871 section 7.3.1 says.
+func ecsScope(res *dns.Msg, opt *dns.OPT) uint8 {
+	client, upstream := findECS(opt), findECS(res.IsEdns0())
+	if client == nil || upstream == nil || upstream.SourceScope == 0 {
+		return 0
+	}
+	// the echo of the subnet sent instead of the one of the client, see upstreamOPT
+	if upstream.Family != client.Family || upstream.SourceNetmask != client.SourceNetmask ||
+		subnetToString(upstream, upstream.SourceNetmask) != ecsToString(opt) {
+		return 0
+	}
+	if upstream.SourceScope > client.SourceNetmask {
+		return client.SourceNetmask
+	}
+	return upstream.SourceScope
+}
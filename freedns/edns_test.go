@@ -0,0 +1,102 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseECS(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"203.0.113.7", "203.0.113.0/24", false},
+		{"203.0.113.7/20", "203.0.112.0/20", false},
+		{"0.0.0.0/0", "0.0.0.0/0", false},
+		{"2001:db8:1:2::1", "2001:db8:1::/56", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"203.0.113.0/33", "", true},
+		{"example.com/24", "", true},
+	}
+	for _, tt := range tests {
+		ecs, err := parseECS(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseECS(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		got := ""
+		if ecs != nil {
+			got = ecsToString(&dns.OPT{Option: []dns.EDNS0{ecs}})
+		}
+		if got != tt.want {
+			t.Errorf("parseECS(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamOPT(t *testing.T) {
+	if upstreamOPT(nil, nil, false) != nil {
+		t.Errorf("No OPT should be sent without EDNS and ECS")
+	}
+
+	clientECS, _ := parseECS("198.51.100.7/24")
+	client := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	client.SetUDPSize(4096)
+	client.SetDo()
+	client.Option = append(client.Option, clientECS, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"})
+
+	opt := upstreamOPT(client, nil, false)
+	if !opt.Do() || opt.UDPSize() != ednsUDPSize || len(opt.Option) != 1 || ecsToString(opt) != "198.51.100.0/24" {
+		t.Errorf("Expect DO and the client subnet without cookie, got %v", opt)
+	}
+
+	ecs, _ := parseECS("203.0.113.0/24")
+	opt = upstreamOPT(client, ecs, false)
+	if len(opt.Option) != 1 || ecsToString(opt) != "203.0.113.0/24" {
+		t.Errorf("Expect the configured client subnet, got %v", opt)
+	}
+	opt = upstreamOPT(client, nil, true)
+	if !opt.Do() || len(opt.Option) != 0 {
+		t.Errorf("Expect the client subnet hidden, got %v", opt)
+	}
+	opt = upstreamOPT(nil, ecs, false)
+	if opt.Do() || ecsToString(opt) != "203.0.113.0/24" {
+		t.Errorf("Expect the configured client subnet without DO, got %v", opt)
+	}
+}
+
+func TestReplyOPT(t *testing.T) {
+	newReply := func() *dns.Msg {
+		ecs, _ := parseECS("198.51.100.0/24")
+		ecs.SourceScope = 16
+		upstream := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}, Option: []dns.EDNS0{ecs}}
+		upstream.SetUDPSize(4096)
+		return &dns.Msg{Extra: []dns.RR{
+			&dns.A{Hdr: dns.RR_Header{Name: "ns.example.com.", Rrtype: dns.TypeA}, A: net.IPv4(127, 0, 0, 1)},
+			upstream,
+		}}
+	}
+
+	res := newReply()
+	replyOPT(res, nil)
+	if len(res.Extra) != 1 || res.IsEdns0() != nil {
+		t.Errorf("OPT should be removed for clients without EDNS, got %v", res.Extra)
+	}
+
+	res = newReply()
+	clientECS, _ := parseECS("198.51.100.7/24")
+	client := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}, Option: []dns.EDNS0{clientECS}}
+	client.SetDo()
+	replyOPT(res, client)
+	opt := res.IsEdns0()
+	if len(res.Extra) != 2 || opt == nil || !opt.Do() || opt.UDPSize() != ednsUDPSize {
+		t.Fatalf("Expect our OPT for the client, got %v", res.Extra)
+	}
+	if ecs := findECS(opt); ecs == nil || ecs.SourceScope != 16 {
+		t.Errorf("Expect the client subnet with scope 16, got %v", ecs)
+	}
+}
@@ -1,6 +1,11 @@
 package freedns
 
 import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
@@ -12,6 +17,61 @@ type Config struct {
 	Listen        string
 	CacheCap      int // the maximum items can be cached
 	LogLevel      string
+
+	// How to choose among multiple upstreams: failover (default), round-robin, random or fastest
+	FastStrategy  string
+	CleanStrategy string
+	// Send the queries to all the clean upstreams at the same time and use the first valid response
+	CleanRace bool
+	// How long to wait for the fast and the clean upstreams, 1.9s by default
+	FastTimeout  time.Duration
+	CleanTimeout time.Duration
+	// Connect to the upstreams through proxy: socks5://[user:pass@]host:port or http://[user:pass@]host:port
+	FastProxy  string
+	CleanProxy string
+	// Comma separated IP addresses of the DNS servers to resolve the hostnames of the upstreams
+	Bootstrap string
+	// Comma separated files of domains which always use the fast or the clean upstream,
+	// either plain domain lists or dnsmasq server=/domain/... rules, reloaded on change
+	FastDomains  string
+	CleanDomains string
+	// The file to save the domains known to belong to China or not, so they survive restarts
+	CNDomainsFile string
+	// How long to trust whether a domain belongs to China, 7 days by default
+	CNDomainsTTL time.Duration
+	// Comma separated gfwlist files (base64 encoded AutoProxy rules), the matched domains use the clean upstream
+	GFWList string
+	// Comma separated files of the IPs or CIDRs only found in forged answers,
+	// also accepting dnsmasq bogus-nxdomain=ip rules
+	BogusIPs string
+	// How long to wait for another UDP reply after the first one from the fast and the clean
+	// upstreams, to detect the injected replies. It delays every plain UDP query to the upstreams
+	// by the window, 0 (the default) disables it
+	FastInjectionWindow  time.Duration
+	CleanInjectionWindow time.Duration
+	// The EDNS Client Subnet sent to the fast and the clean upstreams instead of the one of the client,
+	// ip/prefix, e.g. 203.0.113.0/24. 0.0.0.0/0 asks the upstream not to use the address of the client.
+	// The client subnet of the client is forwarded to the fast upstreams if empty, but not to the clean
+	// upstreams abroad, unless CleanECS is "client"
+	FastECS  string
+	CleanECS string
+	// Validate the answers by DNSSEC, the bogus answers from the fast upstream are discarded,
+	// and the ones from the clean upstream are answered by SERVFAIL
+	DNSSEC bool
+	// The file of the trust anchors for DNSSEC, DS or DNSKEY records in zone file format,
+	// the root trust anchors by default
+	TrustAnchor string
+	// How long NXDOMAIN and NODATA answers are cached at most, 1 hour by default
+	NegativeTTL time.Duration
+	// How long the expired answers are kept, to be served with a TTL of 30s when the upstreams fail.
+	// 0 (the default) disables it
+	ServeStale time.Duration
+	// The TTLs of the answers are clamped into [MinTTL, MaxTTL], 0 means no limit
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// Comma separated domain=duration rules, the TTLs of the answers to the domains and their
+	// subdomains are set to the duration regardless of MinTTL and MaxTTL, e.g. example.com=5m
+	TTLOverrides string
 }
 
 // Server is type of the freedns server instance
@@ -21,6 +81,18 @@ type Server struct {
 	udpServer *dns.Server
 	tcpServer *dns.Server
 
+	// ctx is cancelled by Shutdown, which aborts the pending queries to the upstreams
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// closed once the domains known to belong to China or not are saved for the last time
+	cnDomainsSaved chan struct{}
+
+	// mu guards the listeners of the servers and `closed`
+	mu           sync.Mutex
+	closed       bool
+	shutdownOnce sync.Once
+
 	resolver     *spoofingProofResolver
 	recordsCache *dnsCache
 }
@@ -54,16 +126,54 @@ func NewServer(cfg Config) (*Server, error) {
 
 	s.config = cfg
 
+	ttlPolicy, err := newTTLPolicy(cfg.MinTTL, cfg.MaxTTL, cfg.TTLOverrides)
+	if err != nil {
+		return nil, err
+	}
+
 	var fastUpstreamProvider, cleanUpstreamProvider upstreamProvider
-	fastUpstreamProvider, err = newUpstreamProvider(cfg.FastUpstream)
+	fastUpstreamProvider, err = newUpstreamProvider(cfg.FastUpstream, upstreamOptions{
+		strategy:        cfg.FastStrategy,
+		proxy:           cfg.FastProxy,
+		bootstrap:       cfg.Bootstrap,
+		injectionWindow: cfg.FastInjectionWindow,
+		ecs:             cfg.FastECS,
+	})
 	if err != nil {
 		return nil, err
 	}
-	cleanUpstreamProvider, err = newUpstreamProvider(cfg.CleanUpstream)
+	cleanUpstreamProvider, err = newUpstreamProvider(cfg.CleanUpstream, upstreamOptions{
+		strategy:        cfg.CleanStrategy,
+		proxy:           cfg.CleanProxy,
+		bootstrap:       cfg.Bootstrap,
+		injectionWindow: cfg.CleanInjectionWindow,
+		ecs:             cfg.CleanECS,
+		hideECS:         true,
+	})
 	if err != nil {
+		fastUpstreamProvider.Close()
 		return nil, err
 	}
 
+	var rules *domainRules
+	if cfg.FastDomains != "" || cfg.CleanDomains != "" || cfg.GFWList != "" {
+		if rules, err = newDomainRules(cfg.FastDomains, cfg.CleanDomains, cfg.GFWList); err != nil {
+			fastUpstreamProvider.Close()
+			cleanUpstreamProvider.Close()
+			return nil, err
+		}
+	}
+
+	var bogusIPs *bogusIPList
+	if cfg.BogusIPs != "" {
+		if bogusIPs, err = newBogusIPList(cfg.BogusIPs); err != nil {
+			fastUpstreamProvider.Close()
+			cleanUpstreamProvider.Close()
+			rules.Close()
+			return nil, err
+		}
+	}
+
 	s.config = cfg
 	s.udpServer = &dns.Server{
 		Addr: s.config.Listen,
@@ -82,38 +192,171 @@ func NewServer(cfg Config) (*Server, error) {
 	}
 
 	s.recordsCache = newDNSCache(cfg.CacheCap)
+	if cfg.NegativeTTL > 0 {
+		s.recordsCache.negativeTTL = cfg.NegativeTTL
+	}
+	s.recordsCache.staleWindow = cfg.ServeStale
+	s.recordsCache.ttlPolicy = ttlPolicy
 
 	s.resolver = newSpoofingProofResolver(fastUpstreamProvider, cleanUpstreamProvider, cfg.CacheCap)
+	s.resolver.raceClean = cfg.CleanRace
+	s.resolver.rules = rules
+	s.resolver.bogusIPs = bogusIPs
+	if cfg.FastTimeout > 0 {
+		s.resolver.fastTimeout = cfg.FastTimeout
+	}
+	if cfg.CleanTimeout > 0 {
+		s.resolver.cleanTimeout = cfg.CleanTimeout
+	}
+
+	if cfg.CNDomainsTTL > 0 {
+		s.resolver.cnDomains.ttl = cfg.CNDomainsTTL
+	}
+	if cfg.DNSSEC {
+		if s.resolver.validator, err = newDNSSECValidator(cfg.TrustAnchor, s.resolver.queryClean); err != nil {
+			fastUpstreamProvider.Close()
+			cleanUpstreamProvider.Close()
+			rules.Close()
+			return nil, err
+		}
+	}
+
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if cfg.CNDomainsFile != "" {
+		if err := s.resolver.cnDomains.load(cfg.CNDomainsFile); err != nil {
+			log.WithFields(logrus.Fields{
+				"op":       "load_cn_domains",
+				"filename": cfg.CNDomainsFile,
+			}).Warn("Cannot load, start from scratch: ", err)
+		}
+		s.cnDomainsSaved = make(chan struct{})
+		go s.saveCNDomains()
+	}
 
 	return s, nil
 }
 
-// Run tcp and udp server.
+// Run tcp and udp server. It returns nil once the server is shut down,
+// or the error if it fails to listen or to serve, after which it can run again.
 func (s *Server) Run() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errServerClosed
+	}
+	if s.tcpServer.Listener != nil {
+		s.mu.Unlock()
+		return errServerRunning
+	}
+	l, err := net.Listen("tcp", s.config.Listen)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	pc, err := net.ListenPacket("udp", s.config.Listen)
+	if err != nil {
+		l.Close()
+		s.mu.Unlock()
+		return err
+	}
+	s.tcpServer.Listener = l
+	s.udpServer.PacketConn = pc
+	s.mu.Unlock()
+
 	errChan := make(chan error, 2)
 
 	go func() {
-		err := s.tcpServer.ListenAndServe()
+		err := s.tcpServer.ActivateAndServe()
 		errChan <- err
 	}()
 
 	go func() {
-		err := s.udpServer.ListenAndServe()
+		err := s.udpServer.ActivateAndServe()
 		errChan <- err
 	}()
 
-	select {
-	case err := <-errChan:
-		s.tcpServer.Shutdown()
-		s.udpServer.Shutdown()
-		return err
+	err = <-errChan
+	s.stopServers()
+	<-errChan
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the server can run again once stopped, e.g. after failing to serve
+	s.tcpServer.Listener = nil
+	s.udpServer.PacketConn = nil
+	if s.closed {
+		return nil
 	}
+	return err
 }
 
-// Shutdown shuts down the freedns server
+const (
+	errServerClosed  = Error("The server is shut down")
+	errServerRunning = Error("The server is already running")
+)
+
+// Shutdown shuts down the freedns server and releases the upstreams.
+// It is safe to call Shutdown more than once, or before Run.
 func (s *Server) Shutdown() {
-	s.tcpServer.Shutdown()
-	s.udpServer.Shutdown()
+	s.shutdownOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+
+		s.stopServers()
+		s.cancel()
+		s.resolver.fastUpstreamProvider.Close()
+		s.resolver.cleanUpstreamProvider.Close()
+		s.resolver.rules.Close()
+		if s.cnDomainsSaved != nil {
+			<-s.cnDomainsSaved
+		}
+	})
+}
+
+// cnDomainsSaveInterval is how often the domains known to belong to China or not are saved.
+const cnDomainsSaveInterval = 10 * time.Minute
+
+// saveCNDomains saves the domains known to belong to China or not periodically,
+// and once more when the server is shut down.
+func (s *Server) saveCNDomains() {
+	defer close(s.cnDomainsSaved)
+
+	ticker := time.NewTicker(cnDomainsSaveInterval)
+	defer ticker.Stop()
+	for {
+		stop := false
+		select {
+		case <-ticker.C:
+		case <-s.ctx.Done():
+			stop = true
+		}
+		if err := s.resolver.cnDomains.save(s.config.CNDomainsFile); err != nil {
+			log.WithFields(logrus.Fields{
+				"op":       "save_cn_domains",
+				"filename": s.config.CNDomainsFile,
+			}).Error(err)
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// stopServers stops the tcp and udp servers if they are running.
+func (s *Server) stopServers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// dns.Server.Shutdown fails if the server has not started serving yet,
+	// closing the listener makes it return right after starting.
+	if s.tcpServer.Listener != nil && s.tcpServer.Shutdown() != nil {
+		s.tcpServer.Listener.Close()
+	}
+	if s.udpServer.PacketConn != nil && s.udpServer.Shutdown() != nil {
+		s.udpServer.PacketConn.Close()
+	}
 }
 
 func (s *Server) handle(w dns.ResponseWriter, req *dns.Msg, net string) {
@@ -129,7 +372,15 @@ func (s *Server) handle(w dns.ResponseWriter, req *dns.Msg, net string) {
 		return
 	}
 
-	res, upstream := s.lookup(req, net)
+	res, upstream := s.lookup(s.ctx, req, net)
+	if net == "udp" {
+		// fit in the buffer of the client, which retries over TCP if truncated
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		res.Truncate(size)
+	}
 	w.WriteMsg(res)
 
 	// logging
@@ -149,38 +400,56 @@ func (s *Server) handle(w dns.ResponseWriter, req *dns.Msg, net string) {
 
 // lookup queries the dns request `q` on either the local cache or upstreams,
 // and returns the result and which upstream is used. It updates the local cache
-// if necessary.
-func (s *Server) lookup(req *dns.Msg, net string) (*dns.Msg, string) {
+// if necessary. The cache may be updated in background after lookup returns,
+// so `ctx` should not be cancelled when the request is answered.
+func (s *Server) lookup(ctx context.Context, req *dns.Msg, net string) (*dns.Msg, string) {
+	opt := req.IsEdns0()
+
 	// 1. lookup the cache first
-	res, upd := s.recordsCache.lookup(req.Question[0], req.RecursionDesired, net)
+	res, upd := s.recordsCache.lookup(req.Question[0], req.RecursionDesired, opt, net)
 	var upstream string
 
 	if res != nil {
 		if upd {
 			go func() {
-				r, u := s.resolver.resolve(req.Question[0], req.RecursionDesired, net)
-				if r.Rcode == dns.RcodeSuccess {
+				// the cached answer is shared with the clients validating by themselves or not
+				r, u := s.resolver.resolve(ctx, req.Question[0], req.RecursionDesired, false, opt, net)
+				if cacheable(r) {
 					log.WithFields(logrus.Fields{
 						"op":       "update_cache",
 						"domain":   req.Question[0].Name,
 						"type":     dns.TypeToString[req.Question[0].Qtype],
 						"upstream": u,
 					}).Info()
-					s.recordsCache.set(r, net)
+					s.recordsCache.set(r, opt, net)
 				}
 			}()
 		}
 		upstream = "cache"
 	} else {
-		res, upstream = s.resolver.resolve(req.Question[0], req.RecursionDesired, net)
-		if res.Rcode == dns.RcodeSuccess {
+		res, upstream = s.resolver.resolve(ctx, req.Question[0], req.RecursionDesired, req.CheckingDisabled, opt, net)
+		// the answers from the cache are rewritten already
+		s.recordsCache.ttlPolicy.apply(res)
+		// the answers not validated for the CD bit are not served to the other clients
+		if cacheable(res) && !req.CheckingDisabled {
 			log.WithFields(logrus.Fields{
 				"op":       "update_cache",
 				"domain":   req.Question[0].Name,
 				"type":     dns.TypeToString[req.Question[0].Qtype],
 				"upstream": upstream,
 			}).Info()
-			s.recordsCache.set(res, net)
+			s.recordsCache.set(res, opt, net)
+		} else if res.Rcode == dns.RcodeServerFailure {
+			// the upstreams fail, the expired answer is better than nothing
+			if stale := s.recordsCache.lookupStale(req.Question[0], req.RecursionDesired, opt, net); stale != nil {
+				log.WithFields(logrus.Fields{
+					"op":       "serve_stale",
+					"domain":   req.Question[0].Name,
+					"type":     dns.TypeToString[req.Question[0].Qtype],
+					"upstream": upstream,
+				}).Warn()
+				res, upstream = stale, "stale"
+			}
 		}
 	}
 
@@ -188,5 +457,12 @@ func (s *Server) lookup(req *dns.Msg, net string) (*dns.Msg, string) {
 	rcode := res.Rcode
 	res.SetReply(req)
 	res.Rcode = rcode
+	replyOPT(res, opt)
+	do := opt != nil && opt.Do()
+	// the AD bit is only for the clients asking for it by the DO or the AD bit (RFC 6840 section 5.7)
+	res.AuthenticatedData = res.AuthenticatedData && (do || req.AuthenticatedData)
+	if !do {
+		stripDNSSEC(res)
+	}
 	return res, upstream
 }
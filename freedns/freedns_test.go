@@ -1,33 +1,51 @@
 package freedns
 
 import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 func TestSmokingNewRunAndShutdown(t *testing.T) {
+	fast, stopFast := startTestDNSServerBoth(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(answerStandIn(req))
+	})
+	defer stopFast()
+	srv, _ := startDoHStandIn(t, "/dns-query", answerStandIn)
+	defer srv.Close()
+	clean := srv.URL + "/dns-query"
+
 	// new the server
 	s, err := NewServer(Config{
-		FastUpstream:  "114.114.114.114",
-		CleanUpstream: "8.8.8.8",
-		Listen:        "127.0.0.1:52345",
+		FastUpstream:  fast,
+		CleanUpstream: clean,
+		Listen:        "127.0.0.1:0",
 		CacheCap:      1024 * 5,
 	})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	useDoHStandIn(s.resolver.cleanUpstreamProvider.transports(), srv, clean)
 
-	// run the server
-	shut := make(chan bool, 2)
+	// run the server, and wait for it to stop before returning
+	done := make(chan error, 1)
 	go func() {
-		err := s.Run()
-		if err != nil {
+		done <- s.Run()
+	}()
+	defer func() {
+		s.Shutdown()
+		if err := <-done; err != nil {
 			t.Error(err)
 		}
-		_ = <-shut
-		s.Shutdown()
 	}()
+	addrs := waitRunning(t, s)
 
 	tests := []struct {
 		domain           string
@@ -35,14 +53,14 @@ func TestSmokingNewRunAndShutdown(t *testing.T) {
 		net              string
 		expectedUpstream string
 	}{
-		{"ustc.edu.cn.", dns.TypeMX, "udp", "8.8.8.8:53"},
-		{"ustc.edu.cn.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"ustc.edu.cn.", dns.TypeMX, "udp", "114.114.114.114:53"},
-		{"google.com.", dns.TypeA, "udp", "8.8.8.8:53"},
-		{"mi.cn.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"xiaomi.com.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"youtube.com.", dns.TypeA, "udp", "8.8.8.8:53"},
-		{"twitter.com.", dns.TypeA, "tcp", "8.8.8.8:53"},
+		{"ustc.edu.cn.", dns.TypeMX, "udp", clean},
+		{"ustc.edu.cn.", dns.TypeA, "udp", fast},
+		{"ustc.edu.cn.", dns.TypeMX, "udp", fast},
+		{"google.com.", dns.TypeA, "udp", clean},
+		{"mi.cn.", dns.TypeA, "udp", fast},
+		{"xiaomi.com.", dns.TypeA, "udp", fast},
+		{"youtube.com.", dns.TypeA, "udp", clean},
+		{"twitter.com.", dns.TypeA, "tcp", clean},
 	}
 
 	for _, tt := range tests {
@@ -52,8 +70,8 @@ func TestSmokingNewRunAndShutdown(t *testing.T) {
 			Qclass: dns.ClassINET,
 		}
 
-		want, _ := naiveResolve(q, true, tt.net, tt.expectedUpstream)
-		got, err := naiveResolve(q, true, tt.net, "127.0.0.1:52345")
+		want, _, _ := naiveResolve(context.Background(), q, true, tt.net, tt.expectedUpstream)
+		got, _, err := naiveResolve(context.Background(), q, true, tt.net, addrs[tt.net])
 
 		if err != nil {
 			t.Error(err)
@@ -73,6 +91,254 @@ func TestSmokingNewRunAndShutdown(t *testing.T) {
 			t.Errorf("got different resolve results from expectedUpstream and freedns")
 		}
 	}
+}
+
+// waitRunning waits for `s` to listen, and returns the addresses it listens on by network,
+// which differ if it listens on port 0.
+func waitRunning(t *testing.T, s *Server) map[string]string {
+	for i := 0; i < 100; i++ {
+		s.mu.Lock()
+		l, pc := s.tcpServer.Listener, s.udpServer.PacketConn
+		s.mu.Unlock()
+		if l != nil && pc != nil {
+			return map[string]string{"tcp": l.Addr().String(), "udp": pc.LocalAddr().String()}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("The server is not running")
+	return nil
+}
+
+func TestNewAndShutdownRepeatedly(t *testing.T) {
+	tempfile, err := ioutil.TempFile("", "test_resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempfile.Write([]byte("nameserver 127.0.0.1\n"))
+	tempfile.Close()
+	defer os.Remove(tempfile.Name())
+
+	newServer := func() *Server {
+		s, err := NewServer(Config{
+			FastUpstream:  tempfile.Name(),
+			CleanUpstream: "tls://127.0.0.1",
+			Listen:        "127.0.0.1:0",
+			CacheCap:      16,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		s := newServer()
+		done := make(chan error)
+		go func() {
+			done <- s.Run()
+		}()
+		if i%2 == 0 {
+			// give it a chance to start serving
+			time.Sleep(10 * time.Millisecond)
+		}
+		s.Shutdown()
+		if err := <-done; err != nil && err != errServerClosed {
+			t.Errorf("Run should return nil after Shutdown, got %s", err.Error())
+		}
+		s.Shutdown()
+	}
+
+	s := newServer()
+	s.Shutdown()
+	if err := s.Run(); err != errServerClosed {
+		t.Errorf("Run should fail after Shutdown, got %v", err)
+	}
+
+	// the goroutines of the servers and the file watchers should be gone
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Leaked %d goroutines", after-before)
+	}
+}
 
-	shut <- true
+func TestServerRunsAgainAfterFailure(t *testing.T) {
+	// the port is taken, so listening fails
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(Config{
+		FastUpstream:  "127.0.0.1:53",
+		CleanUpstream: "127.0.0.1:53",
+		Listen:        taken.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	for i := 0; i < 2; i++ {
+		if err := s.Run(); err == nil || err == errServerRunning {
+			t.Errorf("Expect failing to listen, got %v", err)
+		}
+	}
+	taken.Close()
+
+	// serving fails once the listener is closed behind its back
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Run()
+		}()
+		waitRunning(t, s)
+		s.mu.Lock()
+		s.tcpServer.Listener.Close()
+		s.mu.Unlock()
+		if err := <-done; err == nil || err == errServerRunning {
+			t.Errorf("Expect failing to serve, got %v", err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run()
+	}()
+	waitRunning(t, s)
+	s.Shutdown()
+	if err := <-done; err != nil {
+		t.Errorf("Run should return nil after Shutdown, got %v", err)
+	}
+}
+
+func TestServerTruncatesUDPReplies(t *testing.T) {
+	upstream, stopUpstream := startTruncatingDNSServer(t)
+	defer stopUpstream()
+
+	s, err := NewServer(Config{
+		FastUpstream:  upstream,
+		CleanUpstream: upstream,
+		Listen:        "127.0.0.1:0",
+		CacheCap:      16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	addr, stop := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		s.handle(w, req, "udp")
+	})
+	defer stop()
+
+	// without EDNS, the reply must fit in 512 bytes
+	req := &dns.Msg{}
+	req.SetQuestion("many.test.", dns.TypeA)
+	res, err := dns.Exchange(req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Truncated || len(res.Answer) == 0 || len(res.Answer) == 64 {
+		t.Errorf("Expect a truncated reply, got %d records, truncated %v", len(res.Answer), res.Truncated)
+	}
+
+	// the cached answer is complete, and fits in the buffer advertised by EDNS
+	req.SetEdns0(4096, false)
+	res, err = dns.Exchange(req, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Truncated || len(res.Answer) != 64 {
+		t.Errorf("Expect 64 records, got %d records, truncated %v", len(res.Answer), res.Truncated)
+	}
+}
+
+func TestServerServesStale(t *testing.T) {
+	var failing int32
+	upstream, stopUpstream := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		if atomic.LoadInt32(&failing) == 1 {
+			answerServerFailure(w, req)
+			return
+		}
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+		w.WriteMsg(res)
+	})
+	defer stopUpstream()
+
+	s, err := NewServer(Config{
+		FastUpstream:  upstream,
+		CleanUpstream: upstream,
+		Listen:        "127.0.0.1:0",
+		CacheCap:      16,
+		ServeStale:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	req := &dns.Msg{}
+	req.SetQuestion("stale.test.", dns.TypeA)
+	if res, upstream := s.lookup(context.Background(), req, "udp"); res.Rcode != dns.RcodeSuccess || upstream == "stale" {
+		t.Fatalf("Expect a fresh answer, got %v from %s", res, upstream)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	time.Sleep(10 * time.Millisecond)
+	res, upstream := s.lookup(context.Background(), req, "udp")
+	if upstream != "stale" || res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || res.Answer[0].Header().Ttl != staleAnswerTTL {
+		t.Errorf("Expect the stale answer, got %v from %s", res, upstream)
+	}
+}
+
+func TestInjectionWindowPerUpstream(t *testing.T) {
+	s, err := NewServer(Config{
+		FastUpstream:         "127.0.0.1:53",
+		CleanUpstream:        "127.0.0.2:53",
+		Listen:               "127.0.0.1:0",
+		CleanInjectionWindow: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+	if w := s.resolver.fastUpstreamProvider.transports().injectionWindow; w != 0 {
+		t.Errorf("The fast upstreams should not wait for injected replies, got %v", w)
+	}
+	if w := s.resolver.cleanUpstreamProvider.transports().injectionWindow; w != 50*time.Millisecond {
+		t.Errorf("The clean upstreams should wait %v for injected replies, got %v", 50*time.Millisecond, w)
+	}
+}
+
+func TestServerHidesECSFromCleanUpstreams(t *testing.T) {
+	for _, tt := range []struct {
+		cleanECS string
+		hide     bool
+	}{
+		{"", true},
+		{"client", false},
+		{"0.0.0.0/0", false},
+	} {
+		s, err := NewServer(Config{
+			FastUpstream:  "127.0.0.1:53",
+			CleanUpstream: "127.0.0.2:53",
+			Listen:        "127.0.0.1:0",
+			CleanECS:      tt.cleanECS,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.resolver.fastUpstreamProvider.transports().hideECS {
+			t.Errorf("The client subnet should be sent to the fast upstreams")
+		}
+		if hide := s.resolver.cleanUpstreamProvider.transports().hideECS; hide != tt.hide {
+			t.Errorf("-clean-ecs %q: expect hiding the client subnet %v, got %v", tt.cleanECS, tt.hide, hide)
+		}
+		s.Shutdown()
+	}
 }
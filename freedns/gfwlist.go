@@ -0,0 +1,129 @@
+package freedns
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// gfwList matches domains by the rules of a gfwlist, which is in AutoProxy syntax:
+//
+//	! comment
+//	||example.com            the domain and its subdomains
+//	|http://example.com/path urls starting with it, i.e. the host but not its subdomains
+//	example.com/path         urls containing it, which is treated as the host
+//	/regex/                  urls matching the regular expression
+//	@@rule                   exception, the urls matching it are not matched
+//
+// As only domains are known to a DNS server, the rules are reduced to their hosts,
+// and the regular expressions are matched against http://domain/ and https://domain/.
+type gfwList struct {
+	domains    *suffixTrie
+	exceptions *suffixTrie
+	// the hosts of the |-anchored rules, which do not match the subdomains
+	hosts     map[string]bool
+	exHosts   map[string]bool
+	regexps   []*regexp.Regexp
+	exRegexps []*regexp.Regexp
+}
+
+func newGFWList() *gfwList {
+	return &gfwList{
+		domains:    newSuffixTrie(),
+		exceptions: newSuffixTrie(),
+		hosts:      make(map[string]bool),
+		exHosts:    make(map[string]bool),
+	}
+}
+
+// load reads the rules from a gfwlist file, which is usually base64 encoded.
+// The rules which cannot be reduced to domains are skipped.
+func (l *gfwList) load(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	text := string(content)
+	if !strings.HasPrefix(strings.TrimSpace(text), "[AutoProxy") {
+		decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(text), ""))
+		if err != nil {
+			return Error("Invalid gfwlist " + filename + ": " + err.Error())
+		}
+		text = string(decoded)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		if err := l.add(strings.TrimSpace(scanner.Text())); err != nil {
+			log.WithFields(logrus.Fields{
+				"op":       "gfwlist",
+				"filename": filename,
+			}).Debug("Skip rule: ", err)
+		}
+	}
+	return scanner.Err()
+}
+
+// add parses a rule and adds it to the list.
+func (l *gfwList) add(rule string) error {
+	if rule == "" || strings.HasPrefix(rule, "!") || strings.HasPrefix(rule, "[") {
+		return nil
+	}
+
+	domains, hosts, regexps := l.domains, l.hosts, &l.regexps
+	if strings.HasPrefix(rule, "@@") {
+		rule = rule[2:]
+		domains, hosts, regexps = l.exceptions, l.exHosts, &l.exRegexps
+	}
+
+	if len(rule) > 1 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/") {
+		re, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			return err
+		}
+		*regexps = append(*regexps, re)
+		return nil
+	}
+
+	exact := strings.HasPrefix(rule, "|") && !strings.HasPrefix(rule, "||")
+	host := rule
+	for _, prefix := range []string{"||", "|", "http://", "https://", "*.", "."} {
+		host = strings.TrimPrefix(host, prefix)
+	}
+	if i := strings.IndexAny(host, "/:?"); i >= 0 {
+		host = host[:i]
+	}
+	if !isHostname(host) {
+		return Error("Cannot reduce " + rule + " to a domain")
+	}
+	if exact {
+		hosts[strings.ToLower(dns.Fqdn(host))] = true
+	} else {
+		domains.insert(strings.ToLower(dns.Fqdn(host)), routeClean)
+	}
+	return nil
+}
+
+// match returns whether `name` is matched by the list and not by the exceptions.
+func (l *gfwList) match(name string) bool {
+	host := strings.TrimSuffix(strings.ToLower(name), ".")
+	matchRegexps := func(regexps []*regexp.Regexp) bool {
+		for _, re := range regexps {
+			if re.MatchString("http://"+host+"/") || re.MatchString("https://"+host+"/") {
+				return true
+			}
+		}
+		return false
+	}
+
+	fqdn := dns.Fqdn(host)
+	if l.exceptions.match(name) != routeNone || l.exHosts[fqdn] || matchRegexps(l.exRegexps) {
+		return false
+	}
+	return l.domains.match(name) != routeNone || l.hosts[fqdn] || matchRegexps(l.regexps)
+}
@@ -0,0 +1,89 @@
+package freedns
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testGFWList = `[AutoProxy 0.2.9]
+! Checksum: abc
+! comment
+||google.com
+||blocked.example
+@@||allowed.blocked.example
+|http://www.plain.example/path
+.keyword.example
+path.example/some/path
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+@@/^https?:\/\/cn\.blogspot\.com/
+|http://85.17.73.31/
+`
+
+func TestGFWList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_gfwlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	encoded, plain, invalid := dir+"/gfwlist.txt", dir+"/plain.txt", dir+"/invalid.txt"
+	writeTempFile(t, encoded, base64.StdEncoding.EncodeToString([]byte(testGFWList)))
+	writeTempFile(t, plain, testGFWList)
+	writeTempFile(t, invalid, "not base64 !!!")
+
+	if err := newGFWList().load(invalid); err == nil {
+		t.Errorf("Should not load invalid gfwlist")
+	}
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"google.com.", true},
+		{"www.Google.com.", true},
+		{"google.com.hk.", false},
+		{"blocked.example.", true},
+		{"allowed.blocked.example.", false},
+		{"www.allowed.blocked.example.", false},
+		{"www.plain.example.", true},
+		// |-anchored rules match the host only
+		{"foo.www.plain.example.", false},
+		{"plain.example.", false},
+		{"keyword.example.", true},
+		{"path.example.", true},
+		{"foo.blogspot.com.", true},
+		{"cn.blogspot.com.", false},
+		{"example.com.", false},
+	}
+	for _, filename := range []string{encoded, plain} {
+		list := newGFWList()
+		if err := list.load(filename); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			if list.match(tt.name) != tt.expected {
+				t.Errorf("%s should be matched %v by %s", tt.name, tt.expected, filename)
+			}
+		}
+	}
+
+	// the fast and the clean lists take precedence
+	fast := dir + "/fast.conf"
+	writeTempFile(t, fast, "mail.google.com\n")
+	rules, err := newDomainRules(fast, "", encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rules.Close()
+	if r := rules.match("www.google.com."); r != routeClean {
+		t.Errorf("Bad result %s", r)
+	}
+	if r := rules.match("mail.google.com."); r != routeFast {
+		t.Errorf("Bad result %s", r)
+	}
+	if r := rules.match("allowed.blocked.example."); r != routeNone {
+		t.Errorf("Bad result %s", r)
+	}
+}
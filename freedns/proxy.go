@@ -0,0 +1,335 @@
+package freedns
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// dialer opens the connections of the transports, directly or through a proxy.
+type dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// errUDPUnsupported is returned by dialers which cannot carry UDP,
+// the transports fall back to TCP then.
+const errUDPUnsupported = Error("UDP is not supported by the proxy")
+
+const proxyHandshakeTimeout = 2 * time.Second
+
+// newDialer creates the dialer connecting through `proxy`, which is
+// either empty (connect directly), socks5://[user:pass@]host:port or
+// http://[user:pass@]host:port (HTTP CONNECT, TCP only).
+func newDialer(proxy string) (dialer, error) {
+	if proxy == "" {
+		return &net.Dialer{}, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, Error("Invalid proxy " + proxy)
+	}
+	switch u.Scheme {
+	case "socks5":
+		return &socks5Dialer{addr: u.Host, auth: u.User}, nil
+	case "http":
+		return &httpConnectDialer{addr: u.Host, auth: u.User}, nil
+	}
+	return nil, Error("Unsupported proxy scheme " + proxy)
+}
+
+// dialProxy connects to the proxy, and sets the deadline of the connection for the handshake.
+func dialProxy(ctx context.Context, addr string) (net.Conn, error) {
+	d := &net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(proxyHandshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	return conn, nil
+}
+
+// httpConnectDialer tunnels TCP connections by HTTP CONNECT.
+type httpConnectDialer struct {
+	addr string
+	auth *url.Userinfo
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" {
+		return nil, errUDPUnsupported
+	}
+	conn, err := dialProxy(ctx, d.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if d.auth != nil {
+		password, _ := d.auth.Password()
+		token := base64.StdEncoding.EncodeToString([]byte(d.auth.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+token)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, Error("Proxy responded " + resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, Error("Proxy sent unexpected data")
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// socks5Dialer tunnels TCP connections by CONNECT, and UDP by UDP ASSOCIATE (RFC 1928).
+type socks5Dialer struct {
+	addr string
+	auth *url.Userinfo
+}
+
+const (
+	socks5Version       = 5
+	socks5AuthNone      = 0
+	socks5AuthPassword  = 2
+	socks5CmdConnect    = 1
+	socks5CmdAssociate  = 3
+	socks5AddrIPv4      = 1
+	socks5AddrDomain    = 3
+	socks5AddrIPv6      = 4
+	socks5ReplySucceded = 0
+)
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := dialProxy(ctx, d.addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.authenticate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if network == "tcp" {
+		if _, err := socks5Request(conn, socks5CmdConnect, address); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	// UDP ASSOCIATE, the association lives as long as the control connection
+	relay, err := socks5Request(conn, socks5CmdAssociate, "0.0.0.0:0")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		relay.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+	header, err := socks5Addr(address)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	udpConn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: relay.IP, Port: relay.Port})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &socks5UDPConn{
+		UDPConn: udpConn,
+		ctrl:    conn,
+		// RSV(2) FRAG(1) followed by the destination
+		header: append([]byte{0, 0, 0}, header...),
+	}, nil
+}
+
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	method := byte(socks5AuthNone)
+	if d.auth != nil {
+		method = socks5AuthPassword
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return Error("SOCKS5 proxy refused the authentication method")
+	}
+	if method != socks5AuthPassword {
+		return nil
+	}
+
+	// RFC 1929
+	user := d.auth.Username()
+	password, _ := d.auth.Password()
+	if len(user) > 255 || len(password) > 255 {
+		return Error("SOCKS5 username or password too long")
+	}
+	req := []byte{1, byte(len(user))}
+	req = append(req, user...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return Error("SOCKS5 authentication failed")
+	}
+	return nil
+}
+
+// socks5Request sends the command and returns the bound address in the reply.
+func socks5Request(conn net.Conn, cmd byte, address string) (*net.UDPAddr, error) {
+	addr, err := socks5Addr(address)
+	if err != nil {
+		return nil, err
+	}
+	req := append([]byte{socks5Version, cmd, 0}, addr...)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[0] != socks5Version || reply[1] != socks5ReplySucceded {
+		return nil, Error("SOCKS5 request failed with code " + strconv.Itoa(int(reply[1])))
+	}
+
+	var ip net.IP
+	switch reply[3] {
+	case socks5AddrIPv4:
+		ip = make(net.IP, net.IPv4len)
+	case socks5AddrIPv6:
+		ip = make(net.IP, net.IPv6len)
+	case socks5AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		// the domain is not used, only skip it
+		ip = make(net.IP, l[0])
+	default:
+		return nil, Error("SOCKS5 reply has unknown address type")
+	}
+	if _, err := io.ReadFull(conn, ip); err != nil {
+		return nil, err
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return nil, err
+	}
+	if reply[3] == socks5AddrDomain {
+		ip = net.IPv4zero
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
+
+// socks5Addr encodes host:port as ATYP DST.ADDR DST.PORT.
+func socks5Addr(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, Error("Invalid port in " + address)
+	}
+
+	var b []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, Error("Host too long " + host)
+		}
+		b = append([]byte{socks5AddrDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append([]byte{socks5AddrIPv4}, ip4...)
+	} else {
+		b = append([]byte{socks5AddrIPv6}, ip...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// socks5UDPConn sends the datagrams to a single destination through the SOCKS5 relay.
+// It is a net.PacketConn, so the dns package does not frame the messages as TCP.
+type socks5UDPConn struct {
+	*net.UDPConn
+	ctrl   net.Conn
+	header []byte
+}
+
+func (c *socks5UDPConn) Write(p []byte) (int, error) {
+	if _, err := c.UDPConn.Write(append(append([]byte{}, c.header...), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socks5UDPConn) WriteTo(p []byte, _ net.Addr) (int, error) {
+	return c.Write(p)
+}
+
+func (c *socks5UDPConn) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p)+len(c.header)+net.IPv6len)
+	for {
+		n, err := c.UDPConn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		// skip the datagrams not from the destination, or fragmented
+		if n < len(c.header) || string(buf[2:len(c.header)]) != string(c.header[2:]) {
+			continue
+		}
+		return copy(p, buf[len(c.header):n]), nil
+	}
+}
+
+func (c *socks5UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.Read(p)
+	return n, c.RemoteAddr(), err
+}
+
+func (c *socks5UDPConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
@@ -0,0 +1,265 @@
+package freedns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// socks5StandIn is a minimal SOCKS5 proxy supporting CONNECT and UDP ASSOCIATE.
+type socks5StandIn struct {
+	l        net.Listener
+	user     string
+	password string
+	// number of tunneled connections and datagrams
+	tunneled int32
+}
+
+func newSOCKS5StandIn(t *testing.T, user, password string) *socks5StandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5StandIn{l: l, user: user, password: password}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *socks5StandIn) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	io.ReadFull(conn, methods)
+	if s.user == "" {
+		conn.Write([]byte{socks5Version, socks5AuthNone})
+	} else {
+		conn.Write([]byte{socks5Version, socks5AuthPassword})
+		var l [2]byte
+		io.ReadFull(conn, l[:])
+		user := make([]byte, l[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, l[:1])
+		password := make([]byte, l[0])
+		io.ReadFull(conn, password)
+		if string(user) != s.user || string(password) != s.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return
+	}
+	dst := readSOCKS5Addr(conn, req[3])
+
+	if req[1] == socks5CmdConnect {
+		upstream, err := net.Dial("tcp", dst)
+		if err != nil {
+			conn.Write([]byte{socks5Version, 5, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer upstream.Close()
+		atomic.AddInt32(&s.tunneled, 1)
+		conn.Write([]byte{socks5Version, socks5ReplySucceded, 0, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(upstream, conn)
+		io.Copy(conn, upstream)
+		return
+	}
+
+	// UDP ASSOCIATE
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	reply := []byte{socks5Version, socks5ReplySucceded, 0, socks5AddrIPv4, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(reply[8:], uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+	conn.Write(reply)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, client, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(bytes.NewReader(buf[3:n]))
+			var atyp [1]byte
+			io.ReadFull(r, atyp[:])
+			dst := readSOCKS5Addr(r, atyp[0])
+			header := append([]byte{}, buf[:n-r.Buffered()]...)
+			payload := append([]byte{}, buf[n-r.Buffered():n]...)
+
+			upstream, err := net.Dial("udp", dst)
+			if err != nil {
+				continue
+			}
+			upstream.Write(payload)
+			m, err := upstream.Read(buf)
+			upstream.Close()
+			if err != nil {
+				continue
+			}
+			atomic.AddInt32(&s.tunneled, 1)
+			relay.WriteToUDP(append(header, buf[:m]...), client)
+		}
+	}()
+	// the association ends with the control connection
+	io.Copy(ioutil.Discard, conn)
+}
+
+func readSOCKS5Addr(r io.Reader, atyp byte) string {
+	var host string
+	switch atyp {
+	case socks5AddrIPv4:
+		ip := make(net.IP, net.IPv4len)
+		io.ReadFull(r, ip)
+		host = ip.String()
+	case socks5AddrIPv6:
+		ip := make(net.IP, net.IPv6len)
+		io.ReadFull(r, ip)
+		host = ip.String()
+	case socks5AddrDomain:
+		var l [1]byte
+		io.ReadFull(r, l[:])
+		name := make([]byte, l[0])
+		io.ReadFull(r, name)
+		host = string(name)
+	}
+	var port [2]byte
+	io.ReadFull(r, port[:])
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+}
+
+// newHTTPConnectStandIn starts a minimal HTTP CONNECT proxy,
+// and returns its address and the number of tunneled connections.
+func newHTTPConnectStandIn(t *testing.T) (net.Listener, *int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneled := new(int32)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				upstream, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer upstream.Close()
+				atomic.AddInt32(tunneled, 1)
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l, tunneled
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	proxy := newSOCKS5StandIn(t, "user", "secret")
+	defer proxy.l.Close()
+	udpUpstream, stopUDP := startTestDNSServer(t, "udp", answerLocalhost)
+	defer stopUDP()
+	tcpUpstream, stopTCP := startTestDNSServer(t, "tcp", answerLocalhost)
+	defer stopTCP()
+
+	provider, err := newUpstreamProvider(udpUpstream+","+tcpUpstream, upstreamOptions{
+		proxy: "socks5://user:secret@" + proxy.l.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	tests := []struct {
+		net      string
+		upstream string
+	}{
+		{"udp", udpUpstream},
+		{"tcp", tcpUpstream},
+	}
+	for _, tt := range tests {
+		before := atomic.LoadInt32(&proxy.tunneled)
+		res, _, err := provider.transports().resolve(context.Background(), q, true, nil, tt.net, tt.upstream)
+		if err != nil {
+			t.Errorf("Resolve over %s through SOCKS5 failed: %s", tt.net, err.Error())
+		} else if len(res.Answer) != 1 {
+			t.Errorf("Resolve over %s through SOCKS5 got wrong answer %v", tt.net, res)
+		}
+		if atomic.LoadInt32(&proxy.tunneled) != before+1 {
+			t.Errorf("Query over %s is not sent through the proxy", tt.net)
+		}
+	}
+
+	provider, _ = newUpstreamProvider(tcpUpstream, upstreamOptions{
+		proxy: "socks5://user:wrong@" + proxy.l.Addr().String(),
+	})
+	if _, _, err := provider.transports().resolve(context.Background(), q, true, nil, "tcp", tcpUpstream); err == nil {
+		t.Errorf("Should fail with wrong SOCKS5 password")
+	}
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+	l, tunneled := newHTTPConnectStandIn(t)
+	defer l.Close()
+	upstream, stop := startTestDNSServer(t, "tcp", answerLocalhost)
+	defer stop()
+
+	provider, err := newUpstreamProvider(upstream, upstreamOptions{proxy: "http://" + l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// UDP falls back to TCP through HTTP CONNECT
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, _, err := provider.transports().resolve(context.Background(), q, true, nil, "udp", upstream)
+	if err != nil {
+		t.Errorf("Resolve through HTTP CONNECT failed: %s", err.Error())
+	} else if len(res.Answer) != 1 {
+		t.Errorf("Resolve through HTTP CONNECT got wrong answer %v", res)
+	}
+	if atomic.LoadInt32(tunneled) != 1 {
+		t.Errorf("Query is not sent through the proxy")
+	}
+
+	for _, proxy := range []string{"ftp://1.2.3.4", "socks5://"} {
+		if _, err := newUpstreamProvider(upstream, upstreamOptions{proxy: proxy}); err == nil {
+			t.Errorf("Should not create provider with proxy %s", proxy)
+		}
+	}
+}
@@ -1,37 +1,77 @@
 package freedns
 
 import (
+	"context"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	goc "github.com/louchenyao/golang-cache"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 	"github.com/tuna/freedns-go/chinaip"
 )
 
+// defaultResolveTimeout is how long to wait for an upstream by default.
+const defaultResolveTimeout = 1900 * time.Millisecond
+
 // spoofingProofResolver can resolve the DNS request with 100% confidence.
 type spoofingProofResolver struct {
 	fastUpstreamProvider  upstreamProvider
 	cleanUpstreamProvider upstreamProvider
 
+	// how long to wait for the fast and the clean upstreams
+	fastTimeout  time.Duration
+	cleanTimeout time.Duration
+
+	// raceClean sends the queries to all the clean upstreams at the same time,
+	// and takes the first valid response.
+	raceClean bool
+
+	// rules pin the domains in the lists to an upstream, bypassing the detection below.
+	rules *domainRules
+
 	// cnDomains caches if a domain belongs to China.
-	cnDomains *goc.Cache
+	cnDomains *cnDomainCache
+
+	// bogusIPs are the addresses only found in forged answers.
+	bogusIPs *bogusIPList
+	// how many injected replies are detected, see plainTransport.injectionWindow
+	injected uint64
+
+	// validator validates the answers by DNSSEC if not nil, the bogus answers are
+	// taken as forged, and the secure ones are trusted regardless of the addresses.
+	validator *dnssecValidator
+}
+
+// errBogusAnswer means the answer contains a bogus IP, i.e. it is forged.
+const errBogusAnswer = Error("The answer contains a bogus IP")
+
+// spoofed returns whether the error proves the answer is forged.
+func spoofed(err error) bool {
+	return err == errBogusAnswer || err == errInjectedReply || err == errDNSSECBogus
 }
 
 func newSpoofingProofResolver(fastUpstreamProvider upstreamProvider, cleanUpstreamProvider upstreamProvider, cacheCap int) *spoofingProofResolver {
-	c, _ := goc.NewCache("lru", cacheCap)
 	return &spoofingProofResolver{
 		fastUpstreamProvider:  fastUpstreamProvider,
 		cleanUpstreamProvider: cleanUpstreamProvider,
-		cnDomains:             c,
+		fastTimeout:           defaultResolveTimeout,
+		cleanTimeout:          defaultResolveTimeout,
+		cnDomains:             newCNDomainCache(cacheCap, defaultCNDomainsTTL),
 	}
 }
 
-// resovle returns the response and which upstream is used
-func (resolver *spoofingProofResolver) resolve(q dns.Question, recursion bool, net string) (*dns.Msg, string) {
+// resovle returns the response and which upstream is used. `opt` is the OPT record
+// of the client, or nil if it does not speak EDNS. The answers are not validated by
+// DNSSEC if `checkingDisabled`, i.e. the client sets the CD bit to validate them itself.
+// The queries to the upstreams are cancelled once `ctx` is done.
+func (resolver *spoofingProofResolver) resolve(ctx context.Context, q dns.Question, recursion bool, checkingDisabled bool, opt *dns.OPT, net string) (*dns.Msg, string) {
 	type result struct {
-		res *dns.Msg
-		err error
+		res      *dns.Msg
+		err      error
+		upstream string
+		// whether the answer is checked for forgery, see check
+		checked bool
 	}
 	fastCh := make(chan result, 4)
 	cleanCh := make(chan result, 4)
@@ -42,65 +82,221 @@ func (resolver *spoofingProofResolver) resolve(q dns.Question, recursion bool, n
 		},
 	}
 
-	Q := func(ch chan result, upstream string) {
-		res, err := naiveResolve(q, recursion, net, upstream)
+	validator := resolver.validator
+	if checkingDisabled {
+		validator = nil
+	}
+	if validator != nil {
+		// the signatures are needed for the validation
+		opt = withDO(opt)
+	}
+
+	Q := func(ctx context.Context, ch chan result, provider upstreamProvider, upstream string) {
+		res, rtt, err := provider.transports().resolve(ctx, q, recursion, opt, net, upstream)
+		// being cancelled or spoofed says nothing about the upstream
+		if err == errInjectedReply {
+			provider.Report(upstream, rtt, nil)
+		} else if err != context.Canceled {
+			provider.Report(upstream, rtt, err)
+		}
 		if res == nil {
 			res = fail
 		}
-		ch <- result{res, err}
+		ch <- result{res: res, err: err, upstream: upstream}
 	}
 
-	cleanUpstream := resolver.cleanUpstreamProvider.GetUpstream()
-	fastUpstream := resolver.fastUpstreamProvider.GetUpstream()
+	// check turns a forged answer into a failure, and validates it by DNSSEC.
+	// The AD bit is set only if the answer is proven secure.
+	// If an injected reply is detected, the later reply is kept with errInjectedReply.
+	check := func(ctx context.Context, r result) result {
+		r.checked = true
+		if resolver.bogusIPs.contains(r.res) {
+			log.WithFields(logrus.Fields{
+				"op":       "resolve",
+				"upstream": r.upstream,
+				"domain":   q.Name,
+				"count":    resolver.bogusIPs.count(),
+			}).Warn("Forged answer detected")
+			return result{res: fail, err: errBogusAnswer, upstream: r.upstream, checked: true}
+		}
+		if r.err == errInjectedReply {
+			log.WithFields(logrus.Fields{
+				"op":       "resolve",
+				"upstream": r.upstream,
+				"domain":   q.Name,
+				"count":    atomic.AddUint64(&resolver.injected, 1),
+			}).Warn("Injected reply detected")
+		}
+		if validator != nil && r.res != fail {
+			v := validator.validate(ctx, q, r.res)
+			if v == dnssecBogus {
+				log.WithFields(logrus.Fields{
+					"op":       "resolve",
+					"upstream": r.upstream,
+					"domain":   q.Name,
+				}).Warn("Bogus answer detected by DNSSEC")
+				return result{res: fail, err: errDNSSECBogus, upstream: r.upstream, checked: true}
+			}
+			r.res.AuthenticatedData = v == dnssecSecure
+		}
+		return r
+	}
 
-	go Q(cleanCh, cleanUpstream)
-	go Q(fastCh, fastUpstream)
+	// race queries all the upstreams and sends the first valid result, or the last result
+	// if none of them is valid. A forged answer is discarded, so a forger answering first
+	// does not win the race over the genuine answers still on the way.
+	race := func(ctx context.Context, ch chan result, provider upstreamProvider, upstreams []string) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
 
-	// send timeout results
-	go func() {
-		time.Sleep(1900 * time.Millisecond)
-		fastCh <- result{fail, Error("timeout")}
-		cleanCh <- result{fail, Error("timeout")}
-	}()
+		raceCh := make(chan result, len(upstreams))
+		for _, upstream := range upstreams {
+			go Q(ctx, raceCh, provider, upstream)
+		}
+		var r result
+		for range upstreams {
+			r = check(ctx, <-raceCh)
+			if (r.err == nil || r.err == errInjectedReply) && r.res.Rcode != dns.RcodeServerFailure && !r.res.Truncated {
+				break
+			}
+		}
+		ch <- r
+	}
+
+	// the queries still running are cancelled once resolved
+	fastCtx, cancelFast := context.WithTimeout(ctx, resolver.fastTimeout)
+	defer cancelFast()
+	cleanCtx, cancelClean := context.WithTimeout(ctx, resolver.cleanTimeout)
+	defer cancelClean()
+
+	// only query the upstream the domain is pinned to, if any
+	pinned := resolver.rules.match(q.Name)
+
+	var fastUpstream string
+	if pinned != routeClean {
+		fastUpstream = resolver.fastUpstreamProvider.GetUpstream()
+		go Q(fastCtx, fastCh, resolver.fastUpstreamProvider, fastUpstream)
+	}
+
+	var cleanUpstream string
+	if pinned != routeFast {
+		if resolver.raceClean {
+			cleanUpstreams := resolver.cleanUpstreamProvider.GetUpstreams()
+			cleanUpstream = strings.Join(cleanUpstreams, ",")
+			go race(cleanCtx, cleanCh, resolver.cleanUpstreamProvider, cleanUpstreams)
+		} else {
+			cleanUpstream = resolver.cleanUpstreamProvider.GetUpstream()
+			go Q(cleanCtx, cleanCh, resolver.cleanUpstreamProvider, cleanUpstream)
+		}
+	}
+
+	// wait returns the result from `ch`, or a timeout result once `ctx` is done,
+	// in case the transport is slow to give up. The result is checked if not yet, see check.
+	wait := func(ctx context.Context, ch chan result, upstream string) result {
+		var r result
+		select {
+		case r = <-ch:
+		default:
+			select {
+			case r = <-ch:
+			case <-ctx.Done():
+				return result{res: fail, err: ctx.Err(), upstream: upstream}
+			}
+		}
+		if !r.checked {
+			r = check(ctx, r)
+		}
+		return r
+	}
 
 	var r result
-	var upstream string
 
 	for i := 0; i < 1; i++ {
-		// 1. if we can distinguish if it is a china domain, we directly uses the right upstream
-		isCN, ok := resolver.cnDomains.Get(q.Name)
+		// 1. if the domain lists pin the domain, we directly uses that upstream
+		if pinned == routeFast {
+			r = wait(fastCtx, fastCh, fastUpstream)
+			break
+		} else if pinned == routeClean {
+			r = wait(cleanCtx, cleanCh, cleanUpstream)
+			break
+		}
+
+		// 2. if we can distinguish if it is a china domain, we directly uses the right upstream
+		isCN, ok := resolver.cnDomains.get(q.Name)
+		if !ok && q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+			// the answers of other types tell nothing, guess from the parent domains.
+			// the answers of A and AAAA are better evidence than the guess.
+			isCN, ok = resolver.cnDomains.getParent(q.Name)
+		}
 		if ok {
-			if isCN.(bool) {
-				r = <-fastCh
-				upstream = fastUpstream
+			if isCN {
+				r = wait(fastCtx, fastCh, fastUpstream)
+				if spoofed(r.err) {
+					// the domain is poisoned, the verdict must be wrong
+					r = wait(cleanCtx, cleanCh, cleanUpstream)
+				}
 			} else {
-				r = <-cleanCh
-				upstream = cleanUpstream
+				r = wait(cleanCtx, cleanCh, cleanUpstream)
 			}
 			break
 		}
 
-		// 2. try to resolve by fast dns. if it contains A record which means we can decide if this is a china domain
-		r = <-fastCh
-		upstream = fastUpstream
-		if r.res != nil && r.res.Rcode == dns.RcodeSuccess && containsA(r.res) && containsChinaip(r.res) {
+		// 3. try to resolve by fast dns. if it contains A or AAAA record which means we can decide if this is a china domain
+		r = wait(fastCtx, fastCh, fastUpstream)
+		// a domain being spoofed is not trusted to the fast upstream, even by the later reply
+		if r.err != errInjectedReply && r.res != nil && r.res.Rcode == dns.RcodeSuccess && containsIP(r.res) && containsChinaip(r.res) {
+			break
+		}
+		// the answer proven authentic by DNSSEC cannot be spoofed
+		if r.err == nil && validator != nil && r.res.AuthenticatedData {
 			break
 		}
 
-		// 3. the domain may not belong to China, use the clean upstream
-		r = <-cleanCh
-		upstream = cleanUpstream
+		// 4. the domain may not belong to China, or the fast answer is forged, use the clean upstream
+		r = wait(cleanCtx, cleanCh, cleanUpstream)
 	}
 
-	// update cnDomains cache
-	if r.res != nil && r.res.Rcode == dns.RcodeSuccess && containsA(r.res) {
-		resolver.cnDomains.Set(q.Name, containsChinaip(r.res))
+	// update cnDomains cache. The IPv6 ranges are not as complete as the IPv4 ones,
+	// so an answer of IPv6 addresses out of them does not prove the domain is foreign
+	if pinned == routeNone && r.res != nil && r.res.Rcode == dns.RcodeSuccess && containsIP(r.res) &&
+		(containsChinaip(r.res) || containsIPv4(r.res)) {
+		isCN := containsChinaip(r.res)
+		for _, name := range cnameChain(q.Name, r.res) {
+			resolver.cnDomains.set(name, isCN)
+		}
+		resolver.cnDomains.setRegistrable(q.Name, isCN)
+	}
+
+	return r.res, r.upstream
+}
+
+// queryClean queries a clean upstream with the DO bit set, for the DS and DNSKEY
+// records needed by the DNSSEC validation.
+func (resolver *spoofingProofResolver) queryClean(ctx context.Context, q dns.Question) (*dns.Msg, error) {
+	provider := resolver.cleanUpstreamProvider
+	upstream := provider.GetUpstream()
+	res, rtt, err := provider.transports().resolve(ctx, q, true, withDO(nil), "udp", upstream)
+	if err != context.Canceled {
+		provider.Report(upstream, rtt, err)
 	}
+	if err != nil {
+		return nil, err
+	}
+	if res.Rcode != dns.RcodeSuccess && res.Rcode != dns.RcodeNameError {
+		return nil, Error("Cannot query " + q.Name + " " + dns.TypeToString[q.Qtype] + ": " + dns.RcodeToString[res.Rcode])
+	}
+	return res, nil
+}
 
-	return r.res, upstream
+// naiveResolve queries `upstream` by the default transports,
+// and returns the response and the round trip time.
+func naiveResolve(ctx context.Context, q dns.Question, recursion bool, net string, upstream string) (*dns.Msg, time.Duration, error) {
+	return defaultTransports.resolve(ctx, q, recursion, nil, net, upstream)
 }
 
-func naiveResolve(q dns.Question, recursion bool, net string, upstream string) (*dns.Msg, error) {
+// resolve queries `upstream` and returns the response and the round trip time.
+// The EDNS options of the client `opt` are forwarded, see upstreamOPT.
+func (ts *transportSet) resolve(ctx context.Context, q dns.Question, recursion bool, opt *dns.OPT, net string, upstream string) (*dns.Msg, time.Duration, error) {
 	r := &dns.Msg{
 		MsgHdr: dns.MsgHdr{
 			Id:               dns.Id(),
@@ -108,27 +304,68 @@ func naiveResolve(q dns.Question, recursion bool, net string, upstream string) (
 		},
 		Question: []dns.Question{q},
 	}
-	c := &dns.Client{Net: net}
-
-	res, _, err := c.Exchange(r, upstream)
+	if o := upstreamOPT(opt, ts.ecs, ts.hideECS); o != nil {
+		r.Extra = append(r.Extra, o)
+	}
+	var res *dns.Msg
+	var rtt time.Duration
+	t, err := ts.get(upstream)
+	if err == nil {
+		res, rtt, err = t.exchange(ctx, r, net)
+	}
+	// the answer does not fit in a UDP message, ask again over TCP
+	if err == nil && res.Truncated && net == "udp" {
+		res, rtt, err = t.exchange(ctx, r, "tcp")
+	}
 
-	if err != nil {
+	if err == errInjectedReply {
+		// the later reply is returned, the caller decides whether to trust it
+		log.WithFields(logrus.Fields{
+			"op":       "naive_resolve",
+			"upstream": upstream,
+			"domain":   q.Name,
+		}).Warn(err)
+		return res, rtt, err
+	}
+	if err != nil && err != context.Canceled {
 		log.WithFields(logrus.Fields{
 			"op":       "naive_resolve",
 			"upstream": upstream,
 			"domain":   q.Name,
 		}).Error(err)
-		// In case the Rcode is initialized as RcodeSuccess but the error occurs.
-		// Without this, the wrong result may be cached and returned.
-		if res != nil && res.Rcode == dns.RcodeSuccess {
-			res = nil
-		}
 	}
+	// In case the Rcode is initialized as RcodeSuccess but the error occurs.
+	// Without this, the wrong result may be cached and returned.
+	if err != nil && res != nil && res.Rcode == dns.RcodeSuccess {
+		res = nil
+	}
+
+	return res, rtt, err
+}
 
-	return res, err
+// cnameChain returns `name` and the names it is aliased to by the CNAME records in the answer.
+// They all end up with the same addresses.
+func cnameChain(name string, res *dns.Msg) []string {
+	chain := []string{name}
+	for {
+		var target string
+		for _, rr := range res.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+				break
+			}
+		}
+		// stop at the end of the chain, or if it loops
+		if target == "" || len(chain) > len(res.Answer) {
+			return chain
+		}
+		chain = append(chain, target)
+		name = target
+	}
 }
 
-func containsA(res *dns.Msg) bool {
+// containsIP checks if the response contains any A or AAAA record.
+func containsIP(res *dns.Msg) bool {
 	var rrs []dns.RR
 
 	rrs = append(rrs, res.Answer...)
@@ -136,15 +373,27 @@ func containsA(res *dns.Msg) bool {
 	rrs = append(rrs, res.Extra...)
 
 	for i := 0; i < len(rrs); i++ {
-		_, ok := rrs[i].(*dns.A)
-		if ok {
+		switch rrs[i].(type) {
+		case *dns.A, *dns.AAAA:
 			return true
 		}
 	}
 	return false
 }
 
-// containChinaIP check if the resoponse contains IP belonging to China.
+// containsIPv4 checks if the response contains any IPv4 address.
+func containsIPv4(res *dns.Msg) bool {
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if _, ok := rr.(*dns.A); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containChinaIP check if the resoponse contains IPv4 or IPv6 address belonging to China.
 func containsChinaip(res *dns.Msg) bool {
 	var rrs []dns.RR
 
@@ -153,12 +402,17 @@ func containsChinaip(res *dns.Msg) bool {
 	rrs = append(rrs, res.Extra...)
 
 	for i := 0; i < len(rrs); i++ {
-		rr, ok := rrs[i].(*dns.A)
-		if ok {
-			ip := rr.A.String()
-			if chinaip.IsChinaIP(ip) {
-				return true
-			}
+		var ip string
+		switch rr := rrs[i].(type) {
+		case *dns.A:
+			ip = rr.A.String()
+		case *dns.AAAA:
+			ip = rr.AAAA.String()
+		default:
+			continue
+		}
+		if chinaip.IsChinaIP(ip) {
+			return true
 		}
 	}
 	return false
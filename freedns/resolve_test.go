@@ -1,14 +1,58 @@
 package freedns
 
 import (
+	"context"
+	"net"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+// standInAddrs are the addresses of the domains answered by the stand-in upstreams,
+// the China domains resolve to China addresses, the others abroad.
+var standInAddrs = map[string]string{
+	"ustc.edu.cn.": "202.38.64.246",
+	"mi.cn.":       "111.13.104.34",
+	"xiaomi.com.":  "120.92.78.97",
+	"google.com.":  "142.250.72.14",
+	"youtube.com.": "172.217.14.78",
+	"twitter.com.": "104.244.42.1",
+}
+
+// answerStandIn answers A queries by standInAddrs, and MX queries by mx.<domain>.
+func answerStandIn(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetReply(req)
+	q := req.Question[0]
+	addr, ok := standInAddrs[q.Name]
+	if !ok {
+		res.Rcode = dns.RcodeNameError
+		return res
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch q.Qtype {
+	case dns.TypeA:
+		res.Answer = append(res.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(addr)})
+	case dns.TypeMX:
+		res.Answer = append(res.Answer, &dns.MX{Hdr: hdr, Preference: 10, Mx: "mx." + q.Name})
+	}
+	return res
+}
+
 func Test_spoofing_proof_resolver_resolve(t *testing.T) {
-	resolver := newSpoofingProofResolver(&staticUpstreamProvider{"114.114.114.114:53"}, &staticUpstreamProvider{"8.8.8.8:53"}, 1024)
+	fast, stopFast := startTestDNSServerBoth(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		w.WriteMsg(answerStandIn(req))
+	})
+	defer stopFast()
+	srv, _ := startDoHStandIn(t, "/dns-query", answerStandIn)
+	defer srv.Close()
+	clean := srv.URL + "/dns-query"
+
+	cleanProvider := newStaticUpstreamProvider(clean)
+	useDoHStandIn(cleanProvider.transports(), srv, clean)
+	resolver := newSpoofingProofResolver(newStaticUpstreamProvider(fast), cleanProvider, 1024)
 
 	tests := []struct {
 		domain           string
@@ -16,21 +60,19 @@ func Test_spoofing_proof_resolver_resolve(t *testing.T) {
 		net              string
 		expectedUpstream string
 	}{
-		// expect 8.8.8.8 as the upstream b/c the resolver have
+		// expect the clean upstream b/c the resolver have
 		// no way to identify this is an China domain without A records
-		{"ustc.edu.cn.", dns.TypeMX, "udp", "8.8.8.8:53"},
-		{"ustc.edu.cn.", dns.TypeA, "udp", "114.114.114.114:53"},
+		{"ustc.edu.cn.", dns.TypeMX, "udp", clean},
+		{"ustc.edu.cn.", dns.TypeA, "udp", fast},
 		// after querying the A record of ustc.edu.cn,
 		// the resolver should know this is an China domain
-		{"ustc.edu.cn.", dns.TypeMX, "udp", "114.114.114.114:53"},
-		{"google.com.", dns.TypeA, "udp", "8.8.8.8:53"},
-		{"mi.cn.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"xiaomi.com.", dns.TypeA, "udp", "114.114.114.114:53"},
-		{"youtube.com.", dns.TypeA, "udp", "8.8.8.8:53"},
-
-		// This fails just because the GitHub CI server has slow and unstable connection with the 114 server.
-		//{"www.tsinghua.edu.cn.", dns.TypeA, "tcp", "114.114.114.114:53"},
-		{"twitter.com.", dns.TypeA, "tcp", "8.8.8.8:53"},
+		{"ustc.edu.cn.", dns.TypeMX, "udp", fast},
+		{"google.com.", dns.TypeA, "udp", clean},
+		{"mi.cn.", dns.TypeA, "udp", fast},
+		{"xiaomi.com.", dns.TypeA, "udp", fast},
+		{"youtube.com.", dns.TypeA, "udp", clean},
+		{"xiaomi.com.", dns.TypeA, "tcp", fast},
+		{"twitter.com.", dns.TypeA, "tcp", clean},
 	}
 	for _, tt := range tests {
 		t.Run(tt.domain, func(t *testing.T) {
@@ -41,7 +83,7 @@ func Test_spoofing_proof_resolver_resolve(t *testing.T) {
 			}
 
 			start := time.Now()
-			res, upstream := resolver.resolve(q, true, tt.net)
+			res, upstream := resolver.resolve(context.Background(), q, true, false, nil, tt.net)
 			end := time.Now()
 			elapsed := end.Sub(start)
 			if upstream != tt.expectedUpstream {
@@ -54,3 +96,487 @@ func Test_spoofing_proof_resolver_resolve(t *testing.T) {
 		})
 	}
 }
+
+// startTestDNSServer starts a local UDP or TCP DNS server and returns its address.
+func startTestDNSServer(t *testing.T, network string, handler dns.HandlerFunc) (string, func()) {
+	srv := &dns.Server{Handler: handler}
+	var addr string
+	if network == "tcp" {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.Listener, addr = l, l.Addr().String()
+	} else {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.PacketConn, addr = pc, pc.LocalAddr().String()
+	}
+	go srv.ActivateAndServe()
+	return addr, func() { srv.Shutdown() }
+}
+
+func answerServerFailure(w dns.ResponseWriter, req *dns.Msg) {
+	res := &dns.Msg{}
+	res.SetRcode(req, dns.RcodeServerFailure)
+	w.WriteMsg(res)
+}
+
+func Test_spoofing_proof_resolver_race(t *testing.T) {
+	fast, stopFast := startTestDNSServer(t, "udp", answerServerFailure)
+	defer stopFast()
+	failing, stopFailing := startTestDNSServer(t, "udp", answerServerFailure)
+	defer stopFailing()
+	slow, stopSlow := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(time.Second)
+		answerLocalhost(w, req)
+	})
+	defer stopSlow()
+	quick, stopQuick := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		answerLocalhost(w, req)
+	})
+	defer stopQuick()
+
+	clean := newStaticUpstreamProvider(failing, slow, quick)
+	resolver := newSpoofingProofResolver(newStaticUpstreamProvider(fast), clean, 1024)
+	resolver.raceClean = true
+
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	start := time.Now()
+	res, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp")
+	elapsed := time.Since(start)
+
+	if upstream != quick {
+		t.Errorf("Expect the quickest valid upstream %s, got %s", quick, upstream)
+	}
+	if res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 {
+		t.Errorf("Expect the valid answer, got %v", res)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Racing should not wait for the slow upstream, took %v", elapsed)
+	}
+
+	// the cancelled query is not a failure of the slow upstream
+	time.Sleep(100 * time.Millisecond)
+	clean.mu.Lock()
+	if s := clean.find(slow); s.failures != 0 {
+		t.Errorf("Cancelled query should not count as failure")
+	}
+	clean.mu.Unlock()
+
+	// a forged answer arriving first is discarded, and the race goes on
+	forger, stopForger := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("114.114.114.114"),
+		})
+		w.WriteMsg(res)
+	})
+	defer stopForger()
+	resolver = newSpoofingProofResolver(newStaticUpstreamProvider(fast), newStaticUpstreamProvider(forger, quick), 1024)
+	resolver.raceClean = true
+	_, bogus, _ := net.ParseCIDR("114.114.114.0/24")
+	resolver.bogusIPs = &bogusIPList{nets: []*net.IPNet{bogus}}
+	res, upstream = resolver.resolve(context.Background(), q, true, false, nil, "udp")
+	if upstream != quick || res.Rcode != dns.RcodeSuccess || len(res.Answer) != 1 || !res.Answer[0].(*dns.A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expect the genuine answer from %s, got %v from %s", quick, res, upstream)
+	}
+	if count := resolver.bogusIPs.count(); count != 1 {
+		t.Errorf("Expect 1 forged answer, got %d", count)
+	}
+}
+
+func Test_spoofing_proof_resolver_timeout(t *testing.T) {
+	fast, stopFast := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		// never answers
+	})
+	defer stopFast()
+	clean, stopClean := startTestDNSServer(t, "udp", answerLocalhost)
+	defer stopClean()
+
+	resolver := newSpoofingProofResolver(newStaticUpstreamProvider(fast), newStaticUpstreamProvider(clean), 1024)
+	resolver.fastTimeout = 100 * time.Millisecond
+	resolver.cleanTimeout = 100 * time.Millisecond
+
+	before := runtime.NumGoroutine()
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	start := time.Now()
+	res, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp")
+	elapsed := time.Since(start)
+
+	if upstream != clean || res.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expect the answer of the clean upstream, got %v from %s", res, upstream)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Errorf("Should give up the fast upstream after the timeout, took %v", elapsed)
+	}
+
+	// no goroutine is left waiting for the timeout
+	for i := 0; i < 50 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Leaked %d goroutines", after-before)
+	}
+
+	// a cancelled context aborts the resolving
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	res, _ = resolver.resolve(ctx, q, true, false, nil, "udp")
+	if res.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Expect failure with cancelled context, got %v", res)
+	}
+}
+
+func Test_spoofing_proof_resolver_AAAA(t *testing.T) {
+	answerAAAA := func(ip string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			res := &dns.Msg{}
+			res.SetReply(req)
+			res.Answer = append(res.Answer, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				AAAA: net.ParseIP(ip),
+			})
+			w.WriteMsg(res)
+		}
+	}
+	tests := []struct {
+		fastAnswer string
+		expectCN   bool
+	}{
+		{"240e:e9:6002::1", true},
+		{"2001:4860:4860::8888", false},
+		// out of the IPv6 ranges, which may miss some Chinese networks
+		{"2403:a200::1", false},
+	}
+	for _, tt := range tests {
+		fast, stopFast := startTestDNSServer(t, "udp", answerAAAA(tt.fastAnswer))
+		clean, stopClean := startTestDNSServer(t, "udp", answerAAAA("2606:4700:4700::1111"))
+
+		resolver := newSpoofingProofResolver(newStaticUpstreamProvider(fast), newStaticUpstreamProvider(clean), 1024)
+		q := dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+		_, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp")
+
+		expectedUpstream := clean
+		if tt.expectCN {
+			expectedUpstream = fast
+		}
+		if upstream != expectedUpstream {
+			t.Errorf("AAAA %s from fast upstream should be resolved by %s, got %s", tt.fastAnswer, expectedUpstream, upstream)
+		}
+		// only the IPv6 addresses in the China ranges are evidence
+		if isCN, ok := resolver.cnDomains.get(q.Name); ok != tt.expectCN || isCN != tt.expectCN {
+			t.Errorf("AAAA %s should be classified as China %v, got %v (%v)", tt.fastAnswer, tt.expectCN, isCN, ok)
+		}
+
+		stopFast()
+		stopClean()
+	}
+}
+
+func Test_spoofing_proof_resolver_rules(t *testing.T) {
+	queried := make(chan string, 8)
+	answerBy := func(name string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			queried <- name
+			answerLocalhost(w, req)
+		}
+	}
+	fast, stopFast := startTestDNSServer(t, "udp", answerBy("fast"))
+	defer stopFast()
+	clean, stopClean := startTestDNSServer(t, "udp", answerBy("clean"))
+	defer stopClean()
+
+	resolver := newSpoofingProofResolver(newStaticUpstreamProvider(fast), newStaticUpstreamProvider(clean), 1024)
+	resolver.rules = &domainRules{trie: newSuffixTrie()}
+	resolver.rules.trie.insert("fast.test.", routeFast)
+	resolver.rules.trie.insert("clean.test.", routeClean)
+
+	tests := []struct {
+		domain           string
+		expectedUpstream string
+	}{
+		{"www.fast.test.", fast},
+		{"www.clean.test.", clean},
+	}
+	for _, tt := range tests {
+		q := dns.Question{Name: tt.domain, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		_, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp")
+		if upstream != tt.expectedUpstream {
+			t.Errorf("%s should be resolved by %s, got %s", tt.domain, tt.expectedUpstream, upstream)
+		}
+		if _, ok := resolver.cnDomains.get(q.Name); ok {
+			t.Errorf("Pinned domain %s should not be classified", tt.domain)
+		}
+	}
+
+	// the other upstream is not queried at all
+	time.Sleep(50 * time.Millisecond)
+	if len(queried) != 2 || <-queried != "fast" || <-queried != "clean" {
+		t.Errorf("Only the pinned upstream should be queried")
+	}
+}
+
+func Test_spoofing_proof_resolver_inherit(t *testing.T) {
+	fast, stopFast := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		q := req.Question[0]
+		if q.Qtype == dns.TypeA {
+			res.Answer = append(res.Answer,
+				&dns.CNAME{
+					Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+					Target: "cdn.example.cn.",
+				},
+				&dns.A{
+					Hdr: dns.RR_Header{Name: "cdn.example.cn.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   net.ParseIP("114.114.114.114"),
+				})
+		} else {
+			res.Answer = append(res.Answer, &dns.MX{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: 60},
+				Mx:  "mx." + q.Name,
+			})
+		}
+		w.WriteMsg(res)
+	})
+	defer stopFast()
+	clean, stopClean := startTestDNSServer(t, "udp", answerLocalhost)
+	defer stopClean()
+
+	resolver := newSpoofingProofResolver(newStaticUpstreamProvider(fast), newStaticUpstreamProvider(clean), 1024)
+	q := dns.Question{Name: "www.chain.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if _, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp"); upstream != fast {
+		t.Errorf("Expect %s, got %s", fast, upstream)
+	}
+	for _, name := range []string{"www.chain.test.", "cdn.example.cn.", "chain.test."} {
+		if isCN, ok := resolver.cnDomains.get(name); !ok || !isCN {
+			t.Errorf("%s should be classified as China domain", name)
+		}
+	}
+
+	// the MX answer contains no address, the parent domain tells where to go
+	q = dns.Question{Name: "mail.chain.test.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}
+	if _, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp"); upstream != fast {
+		t.Errorf("Subdomain of China domain should be resolved by %s, got %s", fast, upstream)
+	}
+}
+
+func Test_spoofing_proof_resolver_bogus(t *testing.T) {
+	// 114.114.114.114 belongs to China, it would be trusted without the bogus IP list
+	fast, stopFast := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("114.114.114.114"),
+		})
+		w.WriteMsg(res)
+	})
+	defer stopFast()
+	clean, stopClean := startTestDNSServer(t, "udp", answerLocalhost)
+	defer stopClean()
+
+	resolver := newSpoofingProofResolver(newStaticUpstreamProvider(fast), newStaticUpstreamProvider(clean), 1024)
+	_, bogus, _ := net.ParseCIDR("114.114.114.0/24")
+	resolver.bogusIPs = &bogusIPList{nets: []*net.IPNet{bogus}}
+	resolver.rules = &domainRules{trie: newSuffixTrie(), gfwlist: newGFWList()}
+	resolver.rules.trie.insert("pinned.test.", routeFast)
+	resolver.cnDomains.set("known.test.", true)
+
+	tests := []struct {
+		domain           string
+		expectedUpstream string
+		expectedRcode    int
+	}{
+		{"unknown.test.", clean, dns.RcodeSuccess},
+		{"known.test.", clean, dns.RcodeSuccess},
+		{"pinned.test.", fast, dns.RcodeServerFailure},
+	}
+	for _, tt := range tests {
+		q := dns.Question{Name: tt.domain, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		res, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp")
+		if upstream != tt.expectedUpstream || res.Rcode != tt.expectedRcode {
+			t.Errorf("%s should be resolved by %s with %s, got %s with %s", tt.domain,
+				tt.expectedUpstream, dns.RcodeToString[tt.expectedRcode], upstream, dns.RcodeToString[res.Rcode])
+		}
+	}
+
+	for _, name := range []string{"unknown.test.", "known.test."} {
+		if isCN, ok := resolver.cnDomains.get(name); !ok || isCN {
+			t.Errorf("Poisoned domain %s should not be classified as China domain", name)
+		}
+	}
+	if count := resolver.bogusIPs.count(); count != 3 {
+		t.Errorf("Expect 3 forged answers, got %d", count)
+	}
+}
+
+func Test_spoofing_proof_resolver_injected(t *testing.T) {
+	answerA := func(w dns.ResponseWriter, req *dns.Msg, ip string) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		res.Answer = append(res.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		})
+		w.WriteMsg(res)
+	}
+	// the injector answers first with an address in China, the genuine reply follows
+	injected, stopInjected := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		answerA(w, req, "114.114.114.114")
+		time.Sleep(10 * time.Millisecond)
+		answerA(w, req, "127.0.0.1")
+	})
+	defer stopInjected()
+	// the injector may send several forged replies before the genuine one
+	injectedTwice, stopInjectedTwice := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		answerA(w, req, "114.114.114.114")
+		answerA(w, req, "1.2.4.8")
+		time.Sleep(10 * time.Millisecond)
+		answerA(w, req, "127.0.0.1")
+	})
+	defer stopInjectedTwice()
+	duplicated, stopDuplicated := startTestDNSServer(t, "udp", func(w dns.ResponseWriter, req *dns.Msg) {
+		answerA(w, req, "127.0.0.1")
+		answerA(w, req, "127.0.0.1")
+	})
+	defer stopDuplicated()
+	clean, stopClean := startTestDNSServer(t, "udp", answerLocalhost)
+	defer stopClean()
+
+	ts := newTransportSet(&net.Dialer{})
+	ts.injectionWindow = 100 * time.Millisecond
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	res, _, err := ts.resolve(context.Background(), q, true, nil, "udp", injected)
+	if err != errInjectedReply || len(res.Answer) != 1 || !res.Answer[0].(*dns.A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expect the later reply with %v, got %v, %v", errInjectedReply, res, err)
+	}
+	res, _, err = ts.resolve(context.Background(), q, true, nil, "udp", injectedTwice)
+	if err != errInjectedReply || len(res.Answer) != 1 || !res.Answer[0].(*dns.A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expect the last reply with %v, got %v, %v", errInjectedReply, res, err)
+	}
+	if _, _, err := ts.resolve(context.Background(), q, true, nil, "udp", duplicated); err != nil {
+		t.Errorf("Duplicated reply should not be taken as injected, got %v", err)
+	}
+
+	fastProvider := newStaticUpstreamProvider(injected)
+	fastProvider.ts = ts
+	resolver := newSpoofingProofResolver(fastProvider, newStaticUpstreamProvider(clean), 1024)
+	if _, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp"); upstream != clean {
+		t.Errorf("Spoofed domain should be resolved by %s, got %s", clean, upstream)
+	}
+	if isCN, ok := resolver.cnDomains.get(q.Name); !ok || isCN {
+		t.Errorf("Spoofed domain should not be classified as China domain")
+	}
+	if resolver.injected != 1 {
+		t.Errorf("Expect 1 injected reply, got %d", resolver.injected)
+	}
+
+	// the fast upstream answers an address out of China, and the later reply of the clean upstream is used
+	cleanProvider := newStaticUpstreamProvider(injected)
+	cleanProvider.ts = ts
+	resolver = newSpoofingProofResolver(newStaticUpstreamProvider(clean), cleanProvider, 1024)
+	res, upstream := resolver.resolve(context.Background(), q, true, false, nil, "udp")
+	if upstream != injected || len(res.Answer) != 1 || !res.Answer[0].(*dns.A).A.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Expect the later reply of the clean upstream, got %v from %s", res, upstream)
+	}
+}
+
+// startTestDNSServerBoth starts a local DNS server listening on both UDP and TCP of the same port.
+func startTestDNSServerBoth(t *testing.T, handler dns.HandlerFunc) (string, func()) {
+	addr, stopUDP := startTestDNSServer(t, "udp", handler)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		stopUDP()
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: l, Handler: handler}
+	go srv.ActivateAndServe()
+	return addr, func() {
+		stopUDP()
+		srv.Shutdown()
+	}
+}
+
+// startTruncatingDNSServer starts a local DNS server listening on both UDP and TCP,
+// which answers 64 A records over TCP, but only a truncated message over UDP.
+func startTruncatingDNSServer(t *testing.T) (string, func()) {
+	handler := func(w dns.ResponseWriter, req *dns.Msg) {
+		res := &dns.Msg{}
+		res.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			res.Truncated = true
+			w.WriteMsg(res)
+			return
+		}
+		for i := 0; i < 64; i++ {
+			res.Answer = append(res.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(127, 0, 1, byte(i)),
+			})
+		}
+		w.WriteMsg(res)
+	}
+	return startTestDNSServerBoth(t, handler)
+}
+
+func Test_naiveResolve_truncated(t *testing.T) {
+	upstream, stop := startTruncatingDNSServer(t)
+	defer stop()
+
+	q := dns.Question{Name: "many.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	res, _, err := naiveResolve(context.Background(), q, true, "udp", upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Truncated || len(res.Answer) != 64 {
+		t.Errorf("Truncated reply should be retried over TCP, got %d records, truncated %v", len(res.Answer), res.Truncated)
+	}
+}
+
+func Test_spoofing_proof_resolver_ecs(t *testing.T) {
+	received := make(chan string, 2)
+	recordECS := func(name string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, req *dns.Msg) {
+			received <- name + " " + ecsToString(req.IsEdns0())
+			answerLocalhost(w, req)
+		}
+	}
+	fast, stopFast := startTestDNSServer(t, "udp", recordECS("fast"))
+	defer stopFast()
+	clean, stopClean := startTestDNSServer(t, "udp", recordECS("clean"))
+	defer stopClean()
+
+	fastProvider := newStaticUpstreamProvider(fast)
+	fastProvider.ts.ecs, _ = parseECS("203.0.113.0/24")
+	cleanProvider := newStaticUpstreamProvider(clean)
+	resolver := newSpoofingProofResolver(fastProvider, cleanProvider, 1024)
+
+	ecs, _ := parseECS("198.51.100.7/24")
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}, Option: []dns.EDNS0{ecs}}
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	resolver.resolve(context.Background(), q, true, false, opt, "udp")
+
+	got := map[string]bool{<-received: true, <-received: true}
+	for _, want := range []string{"fast 203.0.113.0/24", "clean 198.51.100.0/24"} {
+		if !got[want] {
+			t.Errorf("Expect %q, got %v", want, got)
+		}
+	}
+
+	// the client subnet is kept from the clean upstreams
+	cleanProvider.ts.hideECS = true
+	resolver.cnDomains = newCNDomainCache(1024, time.Hour)
+	resolver.resolve(context.Background(), q, true, false, opt, "udp")
+	got = map[string]bool{<-received: true, <-received: true}
+	if !got["clean "] {
+		t.Errorf("Expect no client subnet sent to the clean upstream, got %v", got)
+	}
+}
@@ -0,0 +1,319 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transport sends DNS messages to a single upstream.
+type transport interface {
+	// exchange sends `req` and returns the reply and the round trip time.
+	// `net` is the protocol the client used, transports bound to a
+	// specific protocol are free to ignore it.
+	// The exchange is aborted with ctx.Err() once `ctx` is done.
+	exchange(ctx context.Context, req *dns.Msg, net string) (*dns.Msg, time.Duration, error)
+	// close releases the connections kept by the transport.
+	close()
+}
+
+const plainTimeout = 2 * time.Second
+
+// plainTransport speaks the classic DNS protocol over UDP or TCP.
+type plainTransport struct {
+	addr   string
+	dialer dialer
+	// injectionWindow is how long to wait for another UDP reply after the first one, 0 disables it
+	injectionWindow time.Duration
+}
+
+// errInjectedReply is returned with the later reply if the first UDP reply turns out to be injected.
+const errInjectedReply = Error("The first reply is injected")
+
+func (t *plainTransport) exchange(ctx context.Context, req *dns.Msg, net string) (*dns.Msg, time.Duration, error) {
+	conn, network, err := dialFallback(ctx, t.dialer, net, t.addr, plainTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	dnsConn := &dns.Conn{Conn: conn}
+	defer dnsConn.Close()
+
+	start := time.Now()
+	res, err := exchangeConn(ctx, dnsConn, req, plainTimeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	rtt := time.Since(start)
+	if network == "udp" && t.injectionWindow > 0 {
+		if later := readLaterReply(ctx, dnsConn, req, res, t.injectionWindow); later != nil {
+			return later, rtt, errInjectedReply
+		}
+	}
+	return res, rtt, nil
+}
+
+// readLaterReply keeps reading from `conn` for `window` after the first reply.
+// The injected replies arrive before the genuine one, as the injector is closer,
+// so a later reply with a different answer proves the first one is injected.
+// As the injector may send several replies, it reads until the window ends,
+// and returns the last reply differing from the first one, or nil if there is none.
+func readLaterReply(ctx context.Context, conn *dns.Conn, req *dns.Msg, first *dns.Msg, window time.Duration) *dns.Msg {
+	ctx, cancel := context.WithTimeout(ctx, window)
+	defer cancel()
+	stop := interruptOnDone(ctx, conn, window)
+	defer stop()
+
+	var later *dns.Msg
+	for {
+		res, err := conn.ReadMsg()
+		if err != nil {
+			return later
+		}
+		if res.Id == req.Id && !sameAnswer(first, res) {
+			later = res
+		}
+	}
+}
+
+// sameAnswer returns whether `a` and `b` have the same rcode and answer records, regardless
+// of the order and TTLs, so a duplicated reply is not mistaken for an injected one.
+func sameAnswer(a *dns.Msg, b *dns.Msg) bool {
+	if a.Rcode != b.Rcode || len(a.Answer) != len(b.Answer) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, rr := range a.Answer {
+		count[rrWithoutTTL(rr)]++
+	}
+	for _, rr := range b.Answer {
+		key := rrWithoutTTL(rr)
+		if count[key] == 0 {
+			return false
+		}
+		count[key]--
+	}
+	return true
+}
+
+func rrWithoutTTL(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	return strings.ToLower(rr.String())
+}
+
+func (t *plainTransport) close() {}
+
+// dialFallback connects to `addr` by `d` before the deadline of `ctx`, or within `timeout`
+// if there is none. It falls back to TCP if `d` cannot carry UDP, and returns the network actually used.
+func dialFallback(ctx context.Context, d dialer, network string, addr string, timeout time.Duration) (net.Conn, string, error) {
+	ctx, cancel := withDefaultTimeout(ctx, timeout)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, network, addr)
+	if err == errUDPUnsupported {
+		network = "tcp"
+		conn, err = d.DialContext(ctx, network, addr)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, network, nil
+}
+
+// exchangeConn sends `req` over an established connection and reads the reply.
+func exchangeConn(ctx context.Context, conn *dns.Conn, req *dns.Msg, timeout time.Duration) (*dns.Msg, error) {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() >= dns.MinMsgSize {
+		conn.UDPSize = opt.UDPSize()
+	}
+
+	stop := interruptOnDone(ctx, conn, timeout)
+	defer stop()
+
+	if err := conn.WriteMsg(req); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	res, err := conn.ReadMsg()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if res.Id != req.Id {
+		return nil, dns.ErrId
+	}
+	return res, nil
+}
+
+// deadliner is a connection or a stream whose pending operations can be interrupted by a deadline.
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// interruptOnDone sets the deadline of `conn` to the deadline of `ctx`, or `timeout`
+// from now if there is none, and interrupts the pending operations on `conn` once
+// `ctx` is done. The returned function must be called when the operations completed.
+func interruptOnDone(ctx context.Context, conn deadliner, timeout time.Duration) func() {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+	}
+}
+
+// withDefaultTimeout returns `ctx` with a deadline `timeout` from now, unless it
+// already has one. So the deadline given by the caller, e.g. the resolve timeout,
+// takes precedence over the default timeouts of the transports.
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// contextError returns the error of `ctx` if it is done, which is the
+// reason of `err`, otherwise `err`.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// transportSet keeps one transport per upstream, so the state of
+// a transport (e.g. HTTP connections) is shared between queries.
+// All the transports of a set connect by the same dialer.
+type transportSet struct {
+	dialer dialer
+	// see plainTransport.injectionWindow
+	injectionWindow time.Duration
+	// the client subnet sent to the upstreams instead of the one of the client, if any
+	ecs *dns.EDNS0_SUBNET
+	// whether the client subnet of the client is kept from the upstreams, see upstreamOPT
+	hideECS bool
+
+	mu     sync.Mutex
+	m      map[string]transport
+	closed bool
+}
+
+// defaultTransports connects to the upstreams directly.
+var defaultTransports = newTransportSet(&net.Dialer{})
+
+func newTransportSet(d dialer) *transportSet {
+	return &transportSet{
+		dialer: d,
+		m:      make(map[string]transport),
+	}
+}
+
+// get returns the transport for `upstream`, creating it on first use.
+func (ts *transportSet) get(upstream string) (transport, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.closed {
+		return nil, errTransportsClosed
+	}
+	if t, ok := ts.m[upstream]; ok {
+		return t, nil
+	}
+	t, err := newTransport(upstream, ts.dialer)
+	if err != nil {
+		return nil, err
+	}
+	if plain, ok := t.(*plainTransport); ok {
+		plain.injectionWindow = ts.injectionWindow
+	}
+	ts.m[upstream] = t
+	return t, nil
+}
+
+const errTransportsClosed = Error("The transports are closed")
+
+// close closes all the transports, and the set cannot be used any more.
+func (ts *transportSet) close() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.closed = true
+	for upstream, t := range ts.m {
+		t.close()
+		delete(ts.m, upstream)
+	}
+}
+
+// isURLUpstream returns whether `upstream` is given in url form, e.g. https://...
+func isURLUpstream(upstream string) bool {
+	return strings.Contains(upstream, "://")
+}
+
+// upstreamHost returns the host of a normalized upstream, which may be a hostname.
+func upstreamHost(upstream string) string {
+	if isURLUpstream(upstream) {
+		if strings.HasPrefix(upstream, "sdns://") {
+			// the address in a stamp is always an IP address
+			return ""
+		}
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return ""
+		}
+		return u.Hostname()
+	}
+	host, _, _ := net.SplitHostPort(upstream)
+	return host
+}
+
+// checkUpstreamURL validates an upstream given in url form.
+func checkUpstreamURL(upstream string) error {
+	var err error
+	switch {
+	case strings.HasPrefix(upstream, "https://"):
+		_, err = parseDoHURL(upstream)
+	case strings.HasPrefix(upstream, "tls://"):
+		_, _, err = parseDoTURL(upstream)
+	case strings.HasPrefix(upstream, "quic://"):
+		_, _, err = parseDoQURL(upstream)
+	case strings.HasPrefix(upstream, "sdns://"):
+		_, err = parseDNSCryptStamp(upstream)
+	default:
+		err = Error("Unsupported upstream scheme " + upstream)
+	}
+	return err
+}
+
+// newTransport picks the transport according to the scheme of the upstream.
+// Upstreams without scheme are plain ip:port addresses.
+func newTransport(upstream string, d dialer) (transport, error) {
+	switch {
+	case strings.HasPrefix(upstream, "https://"):
+		return newDoHTransport(upstream, d)
+	case strings.HasPrefix(upstream, "tls://"):
+		return newDoTTransport(upstream, d)
+	case strings.HasPrefix(upstream, "quic://"):
+		return newDoQTransport(upstream, d)
+	case strings.HasPrefix(upstream, "sdns://"):
+		return newDNSCryptTransport(upstream, d)
+	case isURLUpstream(upstream):
+		return nil, Error("Unsupported upstream scheme " + upstream)
+	}
+	return &plainTransport{addr: upstream, dialer: d}, nil
+}
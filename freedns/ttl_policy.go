@@ -0,0 +1,82 @@
+package freedns
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ttlPolicy rewrites the TTLs of the answers, e.g. to keep the 1-second TTLs of some CDNs
+// from hammering the upstreams, or the day-long ones from slowing down failovers.
+type ttlPolicy struct {
+	// the TTLs are clamped into [min, max] seconds, 0 means no limit
+	min uint32
+	max uint32
+	// overrides maps domains to the TTL of their answers and the answers of their subdomains,
+	// which takes precedence over min and max
+	overrides map[string]uint32
+}
+
+// newTTLPolicy returns the policy clamping the TTLs into [min, max], and overriding them by
+// comma separated domain=duration rules, e.g. example.com=5m. It returns nil if there is nothing to do.
+func newTTLPolicy(min time.Duration, max time.Duration, overrides string) (*ttlPolicy, error) {
+	if min < 0 || max < 0 || (max > 0 && min > max) {
+		return nil, Error("Invalid TTL range " + min.String() + " - " + max.String())
+	}
+	p := &ttlPolicy{
+		min:       uint32(min / time.Second),
+		max:       uint32(max / time.Second),
+		overrides: make(map[string]uint32),
+	}
+	for _, rule := range splitFileList(overrides) {
+		i := strings.LastIndex(rule, "=")
+		if i <= 0 {
+			return nil, Error("Invalid TTL override " + rule)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(rule[i+1:]))
+		if err != nil || ttl < 0 {
+			return nil, Error("Invalid TTL override " + rule)
+		}
+		p.overrides[dns.Fqdn(strings.ToLower(strings.TrimSpace(rule[:i])))] = uint32(ttl / time.Second)
+	}
+	if p.min == 0 && p.max == 0 && len(p.overrides) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// ttl returns the TTL of the records in the answers to `name`, which were given `ttl` by the upstream.
+func (p *ttlPolicy) ttl(name string, ttl uint32) uint32 {
+	// the longest matching domain wins
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	for i := range labels {
+		if override, ok := p.overrides[dns.Fqdn(strings.Join(labels[i:], "."))]; ok {
+			return override
+		}
+	}
+	if ttl < p.min {
+		ttl = p.min
+	}
+	if p.max > 0 && ttl > p.max {
+		ttl = p.max
+	}
+	return ttl
+}
+
+// apply rewrites the TTLs of `res` in place. Only the answers with records are rewritten,
+// the negative answers are cached by their SOA records, see dnsCache.set. It is nil-safe.
+func (p *ttlPolicy) apply(res *dns.Msg) {
+	if p == nil || len(res.Question) == 0 || len(res.Answer) == 0 {
+		return
+	}
+	name := res.Question[0].Name
+	for _, rrs := range [][]dns.RR{res.Answer, res.Ns, res.Extra} {
+		for _, rr := range rrs {
+			if !hasTTL(rr) {
+				continue
+			}
+			rr.Header().Ttl = p.ttl(name, rr.Header().Ttl)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package freedns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTTLPolicy(t *testing.T) {
+	p, err := newTTLPolicy(time.Minute, time.Hour, "example.com=5m, cdn.example.com=1s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		ttl  uint32
+		want uint32
+	}{
+		{"www.example.org.", 1, 60},
+		{"www.example.org.", 600, 600},
+		{"www.example.org.", 86400, 3600},
+		{"example.com.", 1, 300},
+		{"WWW.Example.com.", 86400, 300},
+		{"a.cdn.example.com.", 300, 1},
+		{"notexample.com.", 1, 60},
+	}
+	for _, tt := range tests {
+		if got := p.ttl(tt.name, tt.ttl); got != tt.want {
+			t.Errorf("ttl(%s, %d): expect %d, got %d", tt.name, tt.ttl, tt.want, got)
+		}
+	}
+
+	for _, bad := range []string{"example.com", "=5m", "example.com=forever", "example.com=-1s"} {
+		if _, err := newTTLPolicy(0, 0, bad); err == nil {
+			t.Errorf("%s should be invalid", bad)
+		}
+	}
+	if _, err := newTTLPolicy(time.Hour, time.Minute, ""); err == nil {
+		t.Errorf("Minimum TTL above the maximum should be invalid")
+	}
+	if p, err := newTTLPolicy(0, 0, ""); p != nil || err != nil {
+		t.Errorf("Expect no policy, got %v, %v", p, err)
+	}
+}
+
+func TestCacheTTLPolicy(t *testing.T) {
+	res := &dns.Msg{}
+	res.SetQuestion("example.com.", dns.TypeA)
+	res.Answer = append(res.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1},
+		A:   net.IPv4(127, 0, 0, 1),
+	})
+
+	c := newDNSCache(10)
+	c.ttlPolicy, _ = newTTLPolicy(time.Minute, 0, "")
+	c.set(res, nil, "udp")
+	cached, upd := c.lookup(res.Question[0], true, nil, "udp")
+	if cached == nil || upd || cached.Answer[0].Header().Ttl != 60 {
+		t.Errorf("Expect the answer cached for 60s, got %v", cached)
+	}
+	if res.Answer[0].Header().Ttl != 1 {
+		t.Errorf("The answer to cache should not be modified")
+	}
+}
@@ -0,0 +1,225 @@
+package freedns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// An upstream is demoted after this many consecutive failures.
+	maxUpstreamFailures = 3
+	// A demoted upstream is probed at most once per this interval.
+	upstreamProbeInterval = 30 * time.Second
+)
+
+type upstreamStatus struct {
+	upstream  string
+	failures  int // consecutive failures
+	down      bool
+	probing   bool
+	lastProbe time.Time
+	// moving average of the round trip time
+	rtt time.Duration
+}
+
+// upstreamPool tracks the health of a list of upstreams. It chooses among the
+// upstreams which are not down by the strategy, which defaults to failover.
+//
+// An upstream is down after consecutive failures, and is probed periodically
+// (driven by GetUpstream) until it answers again.
+type upstreamPool struct {
+	mu       sync.Mutex
+	servers  []*upstreamStatus
+	strategy upstreamStrategy
+	ts       *transportSet
+	// the upstream chosen last time, for logging switches
+	active string
+
+	probeInterval time.Duration
+	probe         func(upstream string) (time.Duration, error)
+}
+
+func newUpstreamPool(servers []string) *upstreamPool {
+	p := &upstreamPool{
+		strategy:      failoverStrategy{},
+		ts:            newTransportSet(&net.Dialer{}),
+		probeInterval: upstreamProbeInterval,
+	}
+	p.probe = p.probeUpstream
+	p.update(servers)
+	return p
+}
+
+// transports returns the transports to query the upstreams.
+func (p *upstreamPool) transports() *transportSet {
+	return p.ts
+}
+
+// Close closes the transports of the pool.
+func (p *upstreamPool) Close() error {
+	p.ts.close()
+	return nil
+}
+
+// GetUpstream chooses one of the upstreams which are not down,
+// or the first one if all of them are down.
+func (p *upstreamPool) GetUpstream() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probeDownServers()
+
+	healthy := make([]*upstreamStatus, 0, len(p.servers))
+	for _, s := range p.servers {
+		if !s.down {
+			healthy = append(healthy, s)
+		}
+	}
+	chosen := p.servers[0]
+	if len(healthy) > 0 {
+		chosen = p.strategy.choose(healthy)
+	}
+
+	// switching is expected for strategies spreading the queries
+	spreading := false
+	switch s := p.strategy.(type) {
+	case *roundRobinStrategy, randomStrategy:
+		spreading = true
+	case *fastestStrategy:
+		if s.exploring {
+			// measuring another upstream once is not a switch
+			log.WithFields(logrus.Fields{
+				"op":       "upstream_pool",
+				"active":   p.active,
+				"explored": chosen.upstream,
+			}).Debug("Explore upstream")
+			return chosen.upstream
+		}
+	}
+	if chosen.upstream != p.active {
+		if p.active != "" && !spreading {
+			log.WithFields(logrus.Fields{
+				"op":   "upstream_pool",
+				"from": p.active,
+				"to":   chosen.upstream,
+			}).Warn("Switch upstream")
+		}
+		p.active = chosen.upstream
+	}
+	return chosen.upstream
+}
+
+// GetUpstreams returns all the upstreams which are not down,
+// or all of them if all of them are down.
+func (p *upstreamPool) GetUpstreams() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probeDownServers()
+
+	upstreams := make([]string, 0, len(p.servers))
+	for _, s := range p.servers {
+		if !s.down {
+			upstreams = append(upstreams, s.upstream)
+		}
+	}
+	if len(upstreams) == 0 {
+		for _, s := range p.servers {
+			upstreams = append(upstreams, s.upstream)
+		}
+	}
+	return upstreams
+}
+
+// Report records the result and the round trip time of a query to `upstream`.
+func (p *upstreamPool) Report(upstream string, rtt time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.find(upstream)
+	if s == nil {
+		return
+	}
+	l := log.WithFields(logrus.Fields{
+		"op":       "upstream_pool",
+		"upstream": upstream,
+	})
+
+	if err == nil {
+		s.updateRTT(rtt)
+		s.failures = 0
+		if s.down {
+			s.down = false
+			l.Info("Upstream recovered")
+		}
+		return
+	}
+
+	s.updateRTT(rttFailurePenalty)
+	s.failures++
+	if !s.down && s.failures >= maxUpstreamFailures {
+		s.down = true
+		s.lastProbe = time.Now()
+		l.WithField("failures", s.failures).Warn("Upstream is down")
+	}
+}
+
+// update replaces the list of upstreams, keeping the status of the ones still in the list.
+func (p *upstreamPool) update(servers []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	newServers := make([]*upstreamStatus, 0, len(servers))
+	for _, upstream := range servers {
+		s := p.find(upstream)
+		if s == nil {
+			s = &upstreamStatus{upstream: upstream}
+		}
+		newServers = append(newServers, s)
+	}
+	p.servers = newServers
+}
+
+// find returns the status of `upstream`, the lock must be held.
+func (p *upstreamPool) find(upstream string) *upstreamStatus {
+	for _, s := range p.servers {
+		if s.upstream == upstream {
+			return s
+		}
+	}
+	return nil
+}
+
+// probeDownServers starts probing the upstreams which are down, the lock must be held.
+func (p *upstreamPool) probeDownServers() {
+	now := time.Now()
+	for _, s := range p.servers {
+		if s.down && !s.probing && now.Sub(s.lastProbe) >= p.probeInterval {
+			s.probing = true
+			s.lastProbe = now
+			go func(s *upstreamStatus) {
+				rtt, err := p.probe(s.upstream)
+				p.mu.Lock()
+				s.probing = false
+				p.mu.Unlock()
+				p.Report(s.upstream, rtt, err)
+			}(s)
+		}
+	}
+}
+
+// probeUpstream checks if the upstream answers queries.
+func (p *upstreamPool) probeUpstream(upstream string) (time.Duration, error) {
+	q := dns.Question{
+		Name:   ".",
+		Qtype:  dns.TypeNS,
+		Qclass: dns.ClassINET,
+	}
+	_, rtt, err := p.ts.resolve(context.Background(), q, true, nil, "udp", upstream)
+	return rtt, err
+}
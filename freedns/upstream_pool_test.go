@@ -0,0 +1,159 @@
+package freedns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpstreamPoolFailover(t *testing.T) {
+	pool := newUpstreamPool([]string{"1.1.1.1:53", "8.8.8.8:53"})
+	probed := make(chan string, 10)
+	pool.probeInterval = 0
+	pool.probe = func(upstream string) (time.Duration, error) {
+		probed <- upstream
+		return 0, nil
+	}
+
+	if upstream := pool.GetUpstream(); upstream != "1.1.1.1:53" {
+		t.Errorf("Should prefer the first upstream, got %s", upstream)
+	}
+
+	for i := 0; i < maxUpstreamFailures-1; i++ {
+		pool.Report("1.1.1.1:53", 0, Error("timeout"))
+	}
+	if upstream := pool.GetUpstream(); upstream != "1.1.1.1:53" {
+		t.Errorf("Should not demote before %d failures, got %s", maxUpstreamFailures, upstream)
+	}
+
+	pool.Report("1.1.1.1:53", 0, Error("timeout"))
+	if upstream := pool.GetUpstream(); upstream != "8.8.8.8:53" {
+		t.Errorf("Should fail over to the second upstream, got %s", upstream)
+	}
+
+	// the probe of GetUpstream above restores the first upstream
+	select {
+	case upstream := <-probed:
+		if upstream != "1.1.1.1:53" {
+			t.Errorf("Should probe the demoted upstream, got %s", upstream)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Demoted upstream is not probed")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if upstream := pool.GetUpstream(); upstream != "1.1.1.1:53" {
+		t.Errorf("Should restore the first upstream after probing, got %s", upstream)
+	}
+}
+
+func TestUpstreamPoolAllDown(t *testing.T) {
+	pool := newUpstreamPool([]string{"1.1.1.1:53", "8.8.8.8:53"})
+	pool.probe = func(upstream string) (time.Duration, error) {
+		return 0, Error("timeout")
+	}
+	for i := 0; i < maxUpstreamFailures; i++ {
+		pool.Report("1.1.1.1:53", 0, Error("timeout"))
+		pool.Report("8.8.8.8:53", 0, Error("timeout"))
+	}
+	if upstream := pool.GetUpstream(); upstream != "1.1.1.1:53" {
+		t.Errorf("Should use the first upstream if all are down, got %s", upstream)
+	}
+
+	// the status is kept for servers still in the list
+	pool.update([]string{"9.9.9.9:53", "8.8.8.8:53"})
+	if upstream := pool.GetUpstream(); upstream != "9.9.9.9:53" {
+		t.Errorf("Should use the new upstream, got %s", upstream)
+	}
+	pool.update([]string{"8.8.8.8:53"})
+	if s := pool.find("8.8.8.8:53"); s == nil || !s.down {
+		t.Errorf("Status of 8.8.8.8:53 should be kept")
+	}
+}
+
+func TestUpstreamStrategies(t *testing.T) {
+	servers := []string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"}
+
+	pool := newUpstreamPool(servers)
+	pool.strategy, _ = newUpstreamStrategy("round-robin")
+	seen := make(map[string]bool)
+	for i := 0; i < len(servers); i++ {
+		seen[pool.GetUpstream()] = true
+	}
+	if len(seen) != len(servers) {
+		t.Errorf("Round robin should use every upstream, got %v", seen)
+	}
+
+	pool = newUpstreamPool(servers)
+	pool.strategy, _ = newUpstreamStrategy("fastest")
+	// upstreams without samples are tried first
+	for _, upstream := range servers {
+		if got := pool.GetUpstream(); got != upstream {
+			t.Errorf("Should try %s without samples, got %s", upstream, got)
+		}
+		pool.Report(upstream, 50*time.Millisecond, nil)
+	}
+	for i := 0; i < 10; i++ {
+		pool.Report("1.1.1.1:53", 80*time.Millisecond, nil)
+		pool.Report("8.8.8.8:53", 5*time.Millisecond, nil)
+		pool.Report("9.9.9.9:53", 30*time.Millisecond, nil)
+	}
+	if upstream := pool.GetUpstream(); upstream != "8.8.8.8:53" {
+		t.Errorf("Should use the fastest upstream, got %s", upstream)
+	}
+	// failures count as slow
+	pool.Report("8.8.8.8:53", 0, Error("timeout"))
+	if upstream := pool.GetUpstream(); upstream != "9.9.9.9:53" {
+		t.Errorf("Should avoid the failing upstream, got %s", upstream)
+	}
+
+	// the other upstreams are still tried now and then, which does not switch the active one
+	explored := make(map[string]bool)
+	for i := 0; i < 2*fastestExploreInterval; i++ {
+		explored[pool.GetUpstream()] = true
+		if pool.active != "9.9.9.9:53" {
+			t.Errorf("Exploring should not switch from the fastest upstream to %s", pool.active)
+		}
+	}
+	if !explored["1.1.1.1:53"] || !explored["8.8.8.8:53"] {
+		t.Errorf("Should try the other upstreams now and then, got %v", explored)
+	}
+
+	if _, err := newUpstreamStrategy("slowest"); err == nil {
+		t.Errorf("Should not create unknown strategy")
+	}
+}
+
+func TestFastestStrategyRecovers(t *testing.T) {
+	rtts := map[string]time.Duration{
+		"1.1.1.1:53": 5 * time.Millisecond,
+		"8.8.8.8:53": 30 * time.Millisecond,
+		"9.9.9.9:53": 80 * time.Millisecond,
+	}
+	pool := newUpstreamPool([]string{"1.1.1.1:53", "8.8.8.8:53", "9.9.9.9:53"})
+	pool.strategy, _ = newUpstreamStrategy("fastest")
+	query := func() string {
+		upstream := pool.GetUpstream()
+		pool.Report(upstream, rtts[upstream], nil)
+		return upstream
+	}
+	for i := 0; i < 20; i++ {
+		query()
+	}
+
+	// the fastest upstream times out once, then answers as fast as before
+	pool.Report("1.1.1.1:53", 0, Error("timeout"))
+	if upstream := pool.GetUpstream(); upstream == "1.1.1.1:53" {
+		t.Errorf("Should avoid the upstream which just failed")
+	}
+	for i := 0; i < 5*fastestExploreInterval; i++ {
+		query()
+	}
+	fastest := 0
+	for i := 0; i < fastestExploreInterval; i++ {
+		if query() == "1.1.1.1:53" {
+			fastest++
+		}
+	}
+	if fastest < fastestExploreInterval-1 {
+		t.Errorf("Should use the recovered upstream again, got it %d times in %d queries", fastest, fastestExploreInterval)
+	}
+}
@@ -2,7 +2,9 @@ package freedns
 
 import (
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/miekg/dns"
@@ -10,28 +12,56 @@ import (
 
 type upstreamProvider interface {
 	GetUpstream() string
+	// GetUpstreams returns all the upstreams which can be used now.
+	GetUpstreams() []string
+	// Report tells the provider the result and the round trip time of a query
+	// to `upstream`, so it can avoid the upstreams which are failing or slow.
+	Report(upstream string, rtt time.Duration, err error)
+	// transports returns the transports to query the upstreams.
+	transports() *transportSet
+	// Close releases the resources held by the provider, e.g. connections
+	// and file watchers. The provider cannot be used after Close.
+	Close() error
 }
 
+// upstreamOptions are the options shared by all the upstreams of a provider.
+type upstreamOptions struct {
+	// how to choose among multiple upstreams, see newUpstreamStrategy
+	strategy string
+	// the proxy to connect to the upstreams, see newDialer
+	proxy string
+	// the servers to resolve the hostnames of the upstreams, see newBootstrapDialer
+	bootstrap string
+	// how long to wait for another UDP reply to detect injected ones, see plainTransport
+	injectionWindow time.Duration
+	// the client subnet sent to the upstreams, see parseECS, or clientECS
+	ecs string
+	// whether the client subnet of the clients is kept from the upstreams if `ecs` is empty
+	hideECS bool
+}
+
+// clientECS as upstreamOptions.ecs forwards the client subnet of the clients, even if hideECS.
+const clientECS = "client"
+
 type staticUpstreamProvider struct {
-	upstream string
+	*upstreamPool
 }
 
-func (provider *staticUpstreamProvider) GetUpstream() string {
-	return provider.upstream
+func newStaticUpstreamProvider(servers ...string) *staticUpstreamProvider {
+	return &staticUpstreamProvider{
+		upstreamPool: newUpstreamPool(servers),
+	}
 }
 
 type resolvconfUpstreamProvider struct {
 	filename string
 	// keep last valid servers even if file becomes invalid
-	servers      []string
-	serversMutex sync.RWMutex
-}
+	*upstreamPool
 
-func (provider *resolvconfUpstreamProvider) GetUpstream() string {
-	provider.serversMutex.RLock()
-	defer provider.serversMutex.RUnlock()
-	// Always use the first one for now
-	return provider.servers[0]
+	// closing `done` stops watching the file, `stopped` is closed once the watcher exits
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 }
 
 func parseServersFromResolvconf(filename string) ([]string, error) {
@@ -61,8 +91,10 @@ func newResolvconfUpstreamProvider(filename string) (*resolvconfUpstreamProvider
 	}
 
 	provider := &resolvconfUpstreamProvider{
-		filename: filename,
-		servers:  servers,
+		filename:     filename,
+		upstreamPool: newUpstreamPool(servers),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
 
 	watcher, err := fsnotify.NewWatcher()
@@ -70,16 +102,19 @@ func newResolvconfUpstreamProvider(filename string) (*resolvconfUpstreamProvider
 		return nil, err
 	}
 	if err := watcher.Add(filename); err != nil {
+		watcher.Close()
 		return nil, err
 	}
 	go func() {
-		// TODO: `watcher` will outlive upstream provider
-		// we need to add a Close method to upstreamProvider
+		defer close(provider.stopped)
 		defer watcher.Close()
 		logger := log.WithField("filename", filename)
 		logger.Info("Start watching")
 		for {
 			select {
+			case <-provider.done:
+				logger.Info("Stop watching")
+				return
 			case _, ok := <-watcher.Events:
 				if !ok {
 					logger.Warn("Watch failed")
@@ -97,28 +132,107 @@ func newResolvconfUpstreamProvider(filename string) (*resolvconfUpstreamProvider
 				continue
 			}
 
-			provider.serversMutex.Lock()
-			provider.servers = servers
-			provider.serversMutex.Unlock()
+			provider.update(servers)
 		}
 	}()
 
 	return provider, nil
 }
 
+// Close stops watching the file and closes the transports.
+func (provider *resolvconfUpstreamProvider) Close() error {
+	provider.closeOnce.Do(func() {
+		close(provider.done)
+	})
+	<-provider.stopped
+	return provider.upstreamPool.Close()
+}
+
 // Create upstream provider based on upstream name
 //
 // Possible name values are:
 // IP address (with optional port) :: use this IP as static upstream
+// Hostname (with optional port) :: resolve it by the bootstrap servers, use it as static upstream
+// https:// URL :: use this DNS-over-HTTPS endpoint as static upstream
+// tls://host[:port][?name=servername&pin=spki] :: use this DNS-over-TLS server as static upstream
+// quic://host[:port][?name=servername&pin=spki] :: use this DNS-over-QUIC server as static upstream
+// sdns:// stamp :: use this DNSCrypt server as static upstream
+// Comma separated list of the above :: use the healthy upstreams in the list
 // Filename :: parse the file as resolv.conf, read upstreams from the file (monitor file change)
-func newUpstreamProvider(name string) (upstreamProvider, error) {
-	if addr, err := normalizeDnsAddress(name); err == nil {
-		return &staticUpstreamProvider{
-			upstream: addr,
-		}, nil
+func newUpstreamProvider(name string, opts upstreamOptions) (upstreamProvider, error) {
+	strategy, err := newUpstreamStrategy(opts.strategy)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newDialer(opts.proxy)
+	if err != nil {
+		return nil, err
+	}
+	if d, err = newBootstrapDialer(d, opts.bootstrap); err != nil {
+		return nil, err
 	}
+	hostnames := opts.bootstrap != ""
+	var ecs *dns.EDNS0_SUBNET
+	if opts.ecs != clientECS {
+		if ecs, err = parseECS(opts.ecs); err != nil {
+			return nil, err
+		}
+	}
+	ts := newTransportSet(d)
+	ts.injectionWindow = opts.injectionWindow
+	ts.ecs = ecs
+	ts.hideECS = opts.hideECS && opts.ecs == ""
+
+	var pool *upstreamPool
+	var provider upstreamProvider
+	// check the file first, as the name of a file may also look like a hostname
+	upstream, upstreamErr := normalizeUpstream(name, hostnames)
 	if fileinfo, err := os.Stat(name); err == nil && !fileinfo.IsDir() {
-		return newResolvconfUpstreamProvider(name)
+		p, err := newResolvconfUpstreamProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		pool, provider = p.upstreamPool, p
+	} else if upstreamErr == nil {
+		p := newStaticUpstreamProvider(upstream)
+		pool, provider = p.upstreamPool, p
+	} else if strings.Contains(name, ",") {
+		servers := make([]string, 0)
+		for _, n := range strings.Split(name, ",") {
+			upstream, err := normalizeUpstream(strings.TrimSpace(n), hostnames)
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers, upstream)
+		}
+		p := newStaticUpstreamProvider(servers...)
+		pool, provider = p.upstreamPool, p
+	} else {
+		return nil, Error("Invalid upstream name " + name + ": " + upstreamErr.Error())
+	}
+
+	pool.strategy = strategy
+	pool.ts = ts
+	return provider, nil
+}
+
+// normalizeUpstream validates a single upstream, either an address or an url.
+// The host of the upstream can be a hostname only if `hostnames` is true,
+// i.e. there are bootstrap servers to resolve it.
+func normalizeUpstream(name string, hostnames bool) (string, error) {
+	upstream := name
+	if isURLUpstream(name) {
+		if err := checkUpstreamURL(name); err != nil {
+			return "", err
+		}
+	} else {
+		var err error
+		if upstream, err = normalizeHostAddress(name); err != nil {
+			return "", err
+		}
+	}
+	if !hostnames && isHostname(upstreamHost(upstream)) {
+		return "", Error("Bootstrap servers are required to resolve the hostname of upstream " + name)
 	}
-	return nil, Error("Invalid upstream name " + name)
+	return upstream, nil
 }
@@ -11,16 +11,17 @@ func TestInvalidUpstreamProvider(t *testing.T) {
 	cases := []string{
 		"asdfasdf",
 		"/dev/null",
+		"ftp://1.1.1.1",
 	}
 	for _, name := range cases {
-		if _, err := newUpstreamProvider(name); err == nil {
+		if _, err := newUpstreamProvider(name, upstreamOptions{}); err == nil {
 			t.Errorf("Should not create provider for %s", name)
 		}
 	}
 }
 
 func TestStaticUpstreamProvider(t *testing.T) {
-	provider, err := newUpstreamProvider("8.8.4.4")
+	provider, err := newUpstreamProvider("8.8.4.4", upstreamOptions{})
 	if err != nil || provider == nil {
 		t.Errorf("Cannot create static upstream provider")
 		return
@@ -30,6 +31,29 @@ func TestStaticUpstreamProvider(t *testing.T) {
 	}
 }
 
+func TestUpstreamProviderList(t *testing.T) {
+	provider, err := newUpstreamProvider("8.8.4.4, 1.1.1.1:5353,https://1.0.0.1/dns-query", upstreamOptions{})
+	if err != nil || provider == nil {
+		t.Errorf("Cannot create upstream provider for list")
+		return
+	}
+	pool := provider.(*staticUpstreamProvider).upstreamPool
+	expected := []string{"8.8.4.4:53", "1.1.1.1:5353", "https://1.0.0.1/dns-query"}
+	if len(pool.servers) != len(expected) {
+		t.Errorf("Expect %d upstreams, got %d", len(expected), len(pool.servers))
+		return
+	}
+	for i, s := range pool.servers {
+		if s.upstream != expected[i] {
+			t.Errorf("Bad upstream %s, expect %s", s.upstream, expected[i])
+		}
+	}
+
+	if _, err := newUpstreamProvider("8.8.4.4,asdfasdf", upstreamOptions{}); err == nil {
+		t.Errorf("Should not create provider for list with invalid upstream")
+	}
+}
+
 func TestResolvconfUpstreamProvider(t *testing.T) {
 	tempfile, err := ioutil.TempFile("", "test_resolvconf")
 	if err != nil {
@@ -53,7 +77,7 @@ func TestResolvconfUpstreamProvider(t *testing.T) {
 
 	WriteContent("nameserver 1.2.3.4\n")
 
-	provider, err := newUpstreamProvider(filename)
+	provider, err := newUpstreamProvider(filename, upstreamOptions{})
 	if err != nil {
 		t.Errorf("Cannot create resolvconf upstream provider for %s: %s", filename, err.Error())
 		return
@@ -76,4 +100,21 @@ func TestResolvconfUpstreamProvider(t *testing.T) {
 	if upstream := provider.GetUpstream(); upstream != "8.8.8.8:53" {
 		t.Errorf("Bad result %s", upstream)
 	}
+
+	WriteContent("nameserver 8.8.8.8\nnameserver 8.8.4.4\n")
+	time.Sleep(100 * time.Millisecond)
+	// all nameservers participate
+	for i := 0; i < maxUpstreamFailures; i++ {
+		provider.Report("8.8.8.8:53", 0, Error("timeout"))
+	}
+	if upstream := provider.GetUpstream(); upstream != "8.8.4.4:53" {
+		t.Errorf("Bad result %s", upstream)
+	}
+
+	// can be closed more than once
+	provider.Close()
+	provider.Close()
+	if _, err := provider.transports().get("8.8.8.8:53"); err != errTransportsClosed {
+		t.Errorf("Transports should be closed with the provider")
+	}
 }
@@ -0,0 +1,113 @@
+package freedns
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// weight of the latest sample in the moving average of round trip times
+	rttEWMAWeight = 0.3
+	// round trip time accounted for a failed query
+	rttFailurePenalty = 2 * time.Second
+	// one in this many queries goes to an upstream other than the fastest one
+	fastestExploreInterval = 10
+)
+
+// upstreamStrategy chooses one of the healthy upstreams.
+// It is always called with at least one upstream, and with the pool locked.
+type upstreamStrategy interface {
+	choose(servers []*upstreamStatus) *upstreamStatus
+}
+
+// newUpstreamStrategy creates the strategy by name:
+// failover (default), round-robin, random or fastest.
+func newUpstreamStrategy(name string) (upstreamStrategy, error) {
+	switch name {
+	case "", "failover":
+		return failoverStrategy{}, nil
+	case "round-robin":
+		return &roundRobinStrategy{}, nil
+	case "random":
+		return randomStrategy{}, nil
+	case "fastest":
+		return &fastestStrategy{}, nil
+	}
+	return nil, Error("Invalid upstream strategy " + name)
+}
+
+// failoverStrategy uses the upstreams in order.
+type failoverStrategy struct{}
+
+func (failoverStrategy) choose(servers []*upstreamStatus) *upstreamStatus {
+	return servers[0]
+}
+
+type roundRobinStrategy struct {
+	next int
+}
+
+func (s *roundRobinStrategy) choose(servers []*upstreamStatus) *upstreamStatus {
+	chosen := servers[s.next%len(servers)]
+	s.next = (s.next + 1) % len(servers)
+	return chosen
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) choose(servers []*upstreamStatus) *upstreamStatus {
+	return servers[rand.Intn(len(servers))]
+}
+
+// fastestStrategy uses the upstream with the lowest average round trip time.
+// Upstreams without any samples are tried first. One in fastestExploreInterval queries
+// goes to the other upstreams in turn, so their averages follow how they do now, and
+// an upstream which failed or was slow once gets the chance to prove itself again.
+type fastestStrategy struct {
+	queries int
+	next    int
+	// whether the last choice is one of the others, not the fastest one
+	exploring bool
+}
+
+func (f *fastestStrategy) choose(servers []*upstreamStatus) *upstreamStatus {
+	f.exploring = false
+	best := servers[0]
+	for _, s := range servers {
+		if s.rtt == 0 {
+			return s
+		}
+		if s.rtt < best.rtt {
+			best = s
+		}
+	}
+
+	f.queries++
+	if len(servers) == 1 || f.queries%fastestExploreInterval != 0 {
+		return best
+	}
+	others := make([]*upstreamStatus, 0, len(servers)-1)
+	for _, s := range servers {
+		if s != best {
+			others = append(others, s)
+		}
+	}
+	f.next = (f.next + 1) % len(others)
+	f.exploring = true
+	return others[f.next]
+}
+
+// updateRTT feeds a sample into the moving average of round trip times.
+// The average restarts from `rtt` if the last query failed, as the failure
+// penalty says nothing about how fast the upstream answers once it recovers.
+func (s *upstreamStatus) updateRTT(rtt time.Duration) {
+	if s.failures > 0 {
+		s.rtt = rtt
+		return
+	}
+	if s.rtt == 0 {
+		s.rtt = rtt
+		return
+	}
+	s.rtt = time.Duration(float64(s.rtt)*(1-rttEWMAWeight) + float64(rtt)*rttEWMAWeight)
+}
@@ -1,22 +1,65 @@
 package freedns
 
-import "net"
+import (
+	"net"
+	"strings"
+)
 
 // Parse ip with optional port, return normalized ip:port string
 // For ips without port, default 53 port is appended
 func normalizeDnsAddress(addr string) (string, error) {
+	return normalizeAddress(addr, "53")
+}
+
+// normalizeAddress is normalizeDnsAddress with another default port
+func normalizeAddress(addr string, defaultPort string) (string, error) {
+	host, port := splitAddress(addr, defaultPort)
+	if net.ParseIP(host) == nil {
+		return "", Error("Invalid IP addr: " + host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeHostAddress is normalizeDnsAddress which also accepts hostnames
+func normalizeHostAddress(addr string) (string, error) {
+	host, port := splitAddress(addr, "53")
+	if net.ParseIP(host) == nil && !isHostname(host) {
+		return "", Error("Invalid IP addr or hostname: " + host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// splitAddress splits addr into host and port, the port is optional
+func splitAddress(addr string, defaultPort string) (string, string) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
 		// no port, try parse addr as host with default port
-		host = addr
-		port = "53"
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+		port = defaultPort
 	} else if host == "" {
 		// for addrs like ":53", use default host
 		host = "0.0.0.0"
 	}
+	return host, port
+}
 
-	if net.ParseIP(host) == nil {
-		return "", Error("Invalid IP addr: " + host)
+// isHostname checks if host looks like a fully qualified hostname, e.g. dns.google
+func isHostname(host string) bool {
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(host) > 253 || len(labels) < 2 {
+		return false
 	}
-	return net.JoinHostPort(host, port), nil
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	// there is no numeric top level domain, so malformed ips like 1.2.3.4.5 are not hostnames
+	tld := labels[len(labels)-1]
+	return strings.Trim(tld, "0123456789") != ""
 }
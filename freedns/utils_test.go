@@ -25,4 +25,24 @@ func Test_normalizeDnsAddress(t *testing.T) {
 	assertResult("::1", "[::1]:53")
 	assertResult("[::]:5300", "[::]:5300")
 	assertResult(":5300", "0.0.0.0:5300")
+	assertResult("[::1]", "[::1]:53")
+}
+
+func Test_normalizeHostAddress(t *testing.T) {
+	for _, addr := range []string{"", "hello world", "localhost", "1.2.3.4.5", "-dns.google", "dns..google", "/etc/resolv.conf"} {
+		if res, err := normalizeHostAddress(addr); res != "" || err == nil {
+			t.Errorf("%s should not be normalized as host address", addr)
+		}
+	}
+	cases := map[string]string{
+		"1.2.3.4":         "1.2.3.4:53",
+		"dns.google":      "dns.google:53",
+		"dns.google.:853": "dns.google.:853",
+		"[::1]:5300":      "[::1]:5300",
+	}
+	for addr, expected := range cases {
+		if res, err := normalizeHostAddress(addr); res != expected || err != nil {
+			t.Errorf("%s should be normalized as %s, got %s (%v)", addr, expected, res, err)
+		}
+	}
 }
@@ -1,10 +1,18 @@
 module github.com/tuna/freedns-go
 
-go 1.13
+go 1.21
 
 require (
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/louchenyao/golang-cache v0.0.0-20190309153624-1d1c4bb01145
 	github.com/miekg/dns v1.1.27
+	github.com/quic-go/quic-go v0.41.0
 	github.com/sirupsen/logrus v1.4.2
+	golang.org/x/crypto v0.10.0
+	golang.org/x/net v0.11.0
+)
+
+require (
+	golang.org/x/exp v0.0.0-20230131160201-f062dba9d201 // indirect
+	golang.org/x/sys v0.9.0 // indirect
 )
@@ -4,12 +4,33 @@ import (
 	"flag"
 	"log"
 	"os"
+	"time"
 
 	_ "net/http/pprof"
 
 	"github.com/tuna/freedns-go/freedns"
 )
 
+// upstreamFlag is a flag which can be repeated, the values are joined by commas.
+type upstreamFlag struct {
+	value string
+	set   bool
+}
+
+func (f *upstreamFlag) String() string {
+	return f.value
+}
+
+func (f *upstreamFlag) Set(value string) error {
+	if f.set {
+		f.value += "," + value
+	} else {
+		f.value = value
+		f.set = true
+	}
+	return nil
+}
+
 func main() {
 	/*
 		go func() {
@@ -18,15 +39,65 @@ func main() {
 	*/
 
 	var (
-		fastUpstream  string
-		cleanUpstream string
-		listen        string
-		logLevel      string
+		fastUpstream   = upstreamFlag{value: "114.114.114.114:53"}
+		cleanUpstream  = upstreamFlag{value: "8.8.8.8:53"}
+		fastStrategy   string
+		cleanStrategy  string
+		cleanRace      bool
+		fastTimeout    time.Duration
+		cleanTimeout   time.Duration
+		fastProxy      string
+		cleanProxy     string
+		bootstrap      string
+		fastDomains    string
+		cleanDomains   string
+		gfwlist        string
+		bogusIPs       string
+		fastInjection  time.Duration
+		cleanInjection time.Duration
+		fastECS        string
+		cleanECS       string
+		dnssec         bool
+		trustAnchor    string
+		negativeTTL    time.Duration
+		serveStale     time.Duration
+		minTTL         time.Duration
+		maxTTL         time.Duration
+		ttlOverrides   string
+		cnDomainsFile  string
+		cnDomainsTTL   time.Duration
+		listen         string
+		logLevel       string
 		// cache         bool
 	)
 
-	flag.StringVar(&fastUpstream, "f", "114.114.114.114:53", "The fast/local DNS upstream, ip:port or resolv.conf file")
-	flag.StringVar(&cleanUpstream, "c", "8.8.8.8:53", "The clean/remote DNS upstream., ip:port or resolv.conf file")
+	flag.Var(&fastUpstream, "f", "The fast/local DNS upstream, ip:port or host:port, https://, tls:// or quic:// url, sdns:// stamp or resolv.conf file. Repeat it or separate by commas for failover.")
+	flag.Var(&cleanUpstream, "c", "The clean/remote DNS upstream, ip:port or host:port, https://, tls:// or quic:// url, sdns:// stamp or resolv.conf file. Repeat it or separate by commas for failover.")
+	flag.StringVar(&fastStrategy, "fast-strategy", "failover", "How to choose among multiple fast upstreams: failover/round-robin/random/fastest.")
+	flag.StringVar(&cleanStrategy, "clean-strategy", "failover", "How to choose among multiple clean upstreams: failover/round-robin/random/fastest.")
+	flag.BoolVar(&cleanRace, "clean-race", false, "Query all the clean upstreams at the same time and use the first valid response.")
+	flag.DurationVar(&fastTimeout, "fast-timeout", 1900*time.Millisecond, "How long to wait for the fast upstream.")
+	flag.DurationVar(&cleanTimeout, "clean-timeout", 1900*time.Millisecond, "How long to wait for the clean upstream.")
+	flag.StringVar(&fastProxy, "fast-proxy", "", "Reach the fast upstreams through a proxy, socks5://[user:pass@]host:port or http://host:port.")
+	flag.StringVar(&cleanProxy, "clean-proxy", "", "Reach the clean upstreams through a proxy, socks5://[user:pass@]host:port or http://host:port.")
+	flag.StringVar(&bootstrap, "bootstrap", "", "The DNS servers to resolve the hostnames of the upstreams, ip:port separated by commas.")
+	flag.StringVar(&fastDomains, "fast-domains", "", "Files of domains which always use the fast upstream, plain lists or dnsmasq server=/domain/ rules, separated by commas.")
+	flag.StringVar(&cleanDomains, "clean-domains", "", "Files of domains which always use the clean upstream, plain lists or dnsmasq server=/domain/ rules, separated by commas.")
+	flag.StringVar(&gfwlist, "gfwlist", "", "gfwlist files (base64 encoded AutoProxy rules) of domains which always use the clean upstream, separated by commas.")
+	flag.StringVar(&bogusIPs, "bogus-ips", "", "Files of IPs or CIDRs only found in forged answers, or dnsmasq bogus-nxdomain= rules, separated by commas.")
+	flag.DurationVar(&fastInjection, "fast-injection-window", 0, "How long to wait for another UDP reply from the fast upstreams to detect the injected ones. It delays every UDP query to them, 0 disables it.")
+	flag.DurationVar(&cleanInjection, "clean-injection-window", 0, "How long to wait for another UDP reply from the clean upstreams to detect the injected ones, e.g. 50ms. It delays every UDP query to them, 0 disables it.")
+	flag.StringVar(&fastECS, "fast-ecs", "", "The EDNS Client Subnet sent to the fast upstreams instead of the one of the client, ip/prefix, e.g. 203.0.113.0/24.")
+	flag.StringVar(&cleanECS, "clean-ecs", "", "The EDNS Client Subnet sent to the clean upstreams instead of the one of the client, ip/prefix. By default the one of the client is not sent, \"client\" sends it.")
+	flag.BoolVar(&dnssec, "dnssec", false, "Validate the answers by DNSSEC, and discard the bogus ones.")
+	flag.StringVar(&trustAnchor, "trust-anchor", "", "The file of the DNSSEC trust anchors, DS or DNSKEY records in zone file format. The root trust anchors by default.")
+	flag.StringVar(&cnDomainsFile, "cn-domains-file", "", "The file to save the domains known to belong to China or not, so they survive restarts.")
+	flag.DurationVar(&cnDomainsTTL, "cn-domains-ttl", 7*24*time.Hour, "How long to trust whether a domain belongs to China.")
+	flag.DurationVar(&negativeTTL, "negative-ttl", time.Hour, "How long NXDOMAIN and NODATA answers are cached at most.")
+	flag.DurationVar(&serveStale, "serve-stale", 0, "How long the expired answers are kept to be served when the upstreams fail, e.g. 24h. 0 disables it.")
+	flag.DurationVar(&minTTL, "min-ttl", 0, "The minimum TTL of the answers, e.g. 1m. 0 means no limit.")
+	flag.DurationVar(&maxTTL, "max-ttl", 0, "The maximum TTL of the answers, e.g. 1h. 0 means no limit.")
+	flag.StringVar(&ttlOverrides, "ttl-override", "", "The TTLs of the answers to the domains and their subdomains, domain=duration separated by commas, e.g. example.com=5m.")
 	flag.StringVar(&listen, "l", "0.0.0.0:53", "Listening address.")
 	// flag.BoolVar(&cache, "cache", true, "Enable cache.")
 	flag.StringVar(&logLevel, "log-level", "", "Set log level: info/warn/error.")
@@ -34,11 +105,36 @@ func main() {
 	flag.Parse()
 
 	s, err := freedns.NewServer(freedns.Config{
-		FastUpstream:  fastUpstream,
-		CleanUpstream: cleanUpstream,
-		Listen:        listen,
-		CacheCap:      1024 * 10,
-		LogLevel:      logLevel,
+		FastUpstream:         fastUpstream.value,
+		CleanUpstream:        cleanUpstream.value,
+		FastStrategy:         fastStrategy,
+		CleanStrategy:        cleanStrategy,
+		CleanRace:            cleanRace,
+		FastTimeout:          fastTimeout,
+		CleanTimeout:         cleanTimeout,
+		FastProxy:            fastProxy,
+		CleanProxy:           cleanProxy,
+		Bootstrap:            bootstrap,
+		FastDomains:          fastDomains,
+		CleanDomains:         cleanDomains,
+		GFWList:              gfwlist,
+		BogusIPs:             bogusIPs,
+		FastInjectionWindow:  fastInjection,
+		CleanInjectionWindow: cleanInjection,
+		FastECS:              fastECS,
+		CleanECS:             cleanECS,
+		DNSSEC:               dnssec,
+		TrustAnchor:          trustAnchor,
+		NegativeTTL:          negativeTTL,
+		ServeStale:           serveStale,
+		MinTTL:               minTTL,
+		MaxTTL:               maxTTL,
+		TTLOverrides:         ttlOverrides,
+		CNDomainsFile:        cnDomainsFile,
+		CNDomainsTTL:         cnDomainsTTL,
+		Listen:               listen,
+		CacheCap:             1024 * 10,
+		LogLevel:             logLevel,
 	})
 	if err != nil {
 		log.Fatalln(err)